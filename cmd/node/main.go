@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 	"time"
 
 	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
 	"github.com/webbben/p2p-file-share/internal/network"
 	"github.com/webbben/p2p-file-share/internal/peer"
+	"github.com/webbben/p2p-file-share/internal/ratelimit"
 	"github.com/webbben/p2p-file-share/internal/server"
 	"github.com/webbben/p2p-file-share/internal/state"
 	"github.com/webbben/p2p-file-share/internal/syncdir"
@@ -32,21 +38,109 @@ func main() {
 			return
 		}
 	}
+	// nodes set up before shares had secrets need one to pair with any peers
+	if config.ClusterSecret == "" {
+		fmt.Println("No cluster secret configured")
+		config.ClusterSecret = c.ClusterSecretWorkflow()
+		c.SaveConfig(*config)
+	}
 	fmt.Println("Node nickname:", config.Nickname)
-	fmt.Println("Fileshare directory:", config.SharedDirectoryPath)
+	for _, share := range config.Shares {
+		fmt.Printf("Share %s (%s): %s\n", share.Name, share.ID, share.Path)
+	}
+
+	// all connections with peers are encrypted and authenticated with this node's keypair
+	id, err := c.LoadIdentity(config.Nickname)
+	if err != nil {
+		fmt.Println("Failed to load node identity:", err)
+		os.Exit(1)
+	}
+	network.UseIdentity(id)
+	fmt.Println("Node ID:", id.Fingerprint)
+
+	// load the file index before peers start asking for files,
+	// and catch up on anything that changed while this node wasn't running
+	syncdir.UseSymlinkPolicy(config.GetSymlinkPolicy())
+	syncdir.LoadFileIndex(c.DataFilePath("index.json"))
+	for _, share := range config.Shares {
+		syncdir.ScanLocalChanges(config.ForShare(share))
+	}
+
+	// whenever a peer comes online, sync up the shares it's a member of with everything that changed while it was away
+	state.OnPeerJoined(func(p m.Peer) {
+		for _, share := range config.Shares {
+			if share.HasMember(p.ID) {
+				syncdir.ReconcileWithPeer(p, config.ForShare(share))
+			}
+		}
+	})
+
+	ratelimit.Apply(*config, time.Now())
+
+	// shut down gracefully on Ctrl+C or when the system stops the node
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// start the message server to handle incoming connections from peers
+	serverDone := make(chan struct{})
+	go func() {
+		server.MessageServer(ctx, *config)
+		close(serverDone)
+	}()
 
 	// get an initial set of peers
-	peers := peer.DiscoverPeers()
+	peers := peer.DiscoverPeers(*config)
 	state.SetPeers(peers)
 
-	// start the message server to handle incoming connections from peers
-	go server.MessageServer(*config)
-	// watch for changes to the shared file directory
-	go syncdir.WatchForFileChanges(config.SharedDirectoryPath)
+	// watch for changes to the directory of each share
+	for _, share := range config.Shares {
+		go syncdir.WatchForFileChanges(config.ForShare(share))
+	}
 
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(1 * time.Minute)
-		peers = peer.DiscoverPeers()
+		select {
+		case <-ctx.Done():
+			fmt.Println("shutting down...")
+			<-serverDone
+			syncdir.FlushFileIndex()
+			return
+		case <-ticker.C:
+		}
+		peers = peer.DiscoverPeers(*config)
 		state.SetPeers(peers)
+		printTransferQueue()
+		// pick up any changes to the rate limits, and move on to the next scheduled limits
+		if reloaded := c.LoadConfig(); reloaded != nil {
+			ratelimit.Apply(*reloaded, time.Now())
+		}
+	}
+}
+
+// shows the remote changes that are being applied or waiting their turn, if there are any
+func printTransferQueue() {
+	queue := syncdir.GetTransferQueue()
+	if len(queue) == 0 {
+		return
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		if queue[i].Active != queue[j].Active {
+			return queue[i].Active
+		}
+		return queue[i].QueuedAt.Before(queue[j].QueuedAt)
+	})
+	fmt.Printf("transfer queue (%v):\n", len(queue))
+	rows := make([][]string, 0, len(queue))
+	for _, status := range queue {
+		progress := "waiting"
+		if status.Active {
+			progress = "active"
+		}
+		if status.Pinned {
+			progress += ", pinned"
+		}
+		rows = append(rows, []string{status.Share, status.File, status.Change, fmt.Sprint(status.Size), status.Peer, progress, status.QueuedAt.Format(time.TimeOnly)})
 	}
+	ui.PrintTable([]string{"SHARE", "FILE", "CHANGE", "SIZE", "PEER", "STATE", "QUEUED"}, rows)
 }
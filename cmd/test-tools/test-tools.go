@@ -9,7 +9,11 @@ import (
 	"fmt"
 	"os"
 
+	c "github.com/webbben/p2p-file-share/internal/config"
 	filetransfer "github.com/webbben/p2p-file-share/internal/file-transfer"
+	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/network"
+	"github.com/webbben/p2p-file-share/internal/peer"
 )
 
 func main() {
@@ -18,6 +22,7 @@ func main() {
 	// Define flags specific to the "test" command
 	reqFileArg := requestFileCmd.String("file", "", "file to request")
 	reqIpArg := requestFileCmd.String("ip", "", "IP of node to request file from")
+	reqShareArg := requestFileCmd.String("share", c.DEFAULT_SHARE_ID, "ID of the share the file is in")
 
 	// Parse command-line arguments
 	if len(os.Args) < 2 {
@@ -37,8 +42,36 @@ func main() {
 			fmt.Println("Error: ip argument is required for requestFile command")
 			os.Exit(1)
 		}
+		config := c.LoadConfig()
+		if config == nil {
+			fmt.Println("Error: a config is required to connect to other nodes")
+			os.Exit(1)
+		}
+		id, err := c.LoadIdentity(config.Nickname)
+		if err != nil {
+			fmt.Println("Error: failed to load node identity:", err)
+			os.Exit(1)
+		}
+		network.UseIdentity(id)
+		share, exists := config.GetShare(*reqShareArg)
+		if !exists {
+			fmt.Println("Error: no share with ID", *reqShareArg)
+			os.Exit(1)
+		}
+		// the node has to be one we've paired with, so we know which ID to expect at its IP
+		sender := m.Peer{IP: *reqIpArg}
+		for peerID, known := range peer.GetKnownPeers() {
+			if known.IP == *reqIpArg {
+				sender.ID = peerID
+				sender.Nickname = known.Nickname
+			}
+		}
+		if sender.ID == "" {
+			fmt.Println("Error: no known peer at", *reqIpArg)
+			os.Exit(1)
+		}
 		fmt.Printf("Requesting file %s from node %s\n", *reqFileArg, *reqIpArg)
-		filetransfer.RequestFile(*reqIpArg, *reqFileArg)
+		filetransfer.RequestFile(sender, config.ForShare(share), *reqFileArg, nil, nil)
 	default:
 		fmt.Println("Unknown command:", os.Args[1])
 		os.Exit(1)
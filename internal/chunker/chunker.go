@@ -0,0 +1,85 @@
+// splits files into content-defined chunks, using FastCDC.
+//
+// chunk boundaries are chosen by the contents around them rather than by their offset in the file,
+// so inserting or removing bytes only changes the chunks near the edit, and identical data in different files ends up in identical chunks.
+package chunker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	MIN_SIZE int = 16 * 1024  // chunks are never smaller than this, except the last chunk of a file
+	AVG_SIZE int = 64 * 1024  // chunks are about this size on average
+	MAX_SIZE int = 256 * 1024 // chunks are never bigger than this
+)
+
+// masks for finding a chunk boundary in the rolling hash. below the average size a boundary is harder to find (more bits have to be zero),
+// and above it easier, so that chunk sizes stay close to the average ("normalized chunking" in the FastCDC paper).
+const (
+	maskS uint64 = ((1 << 18) - 1) << (64 - 18)
+	maskL uint64 = ((1 << 14) - 1) << (64 - 14)
+)
+
+// random values for each byte, mixed into the rolling hash. these have to be the same on every node, so they're generated from a fixed seed.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x5eed)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type Chunker struct {
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func New(r io.Reader) *Chunker {
+	return &Chunker{
+		reader: bufio.NewReaderSize(r, MAX_SIZE),
+		buf:    make([]byte, 0, MAX_SIZE),
+	}
+}
+
+// gets the next chunk. returns io.EOF once there are no more chunks.
+//
+// the returned slice is only valid until the next call to Next.
+func (c *Chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < MAX_SIZE {
+		b, err := c.reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		// no point looking for a boundary before the minimum size
+		if len(c.buf) < MIN_SIZE {
+			continue
+		}
+		hash = (hash << 1) + gear[b]
+		mask := maskL
+		if len(c.buf) < AVG_SIZE {
+			mask = maskS
+		}
+		if hash&mask == 0 {
+			return c.buf, nil
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
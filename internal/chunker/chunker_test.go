@@ -0,0 +1,73 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// splits data into chunks, and returns the hash of each
+func chunkHashes(t *testing.T, data []byte) [][32]byte {
+	hashes := [][32]byte{}
+	var reassembled []byte
+	c := New(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal("failed to get next chunk:", err)
+		}
+		if len(chunk) > MAX_SIZE {
+			t.Errorf("chunk of %v bytes is bigger than the maximum size", len(chunk))
+		}
+		if len(chunk) < MIN_SIZE && len(reassembled)+len(chunk) != len(data) {
+			t.Errorf("chunk of %v bytes is smaller than the minimum size, but isn't the last chunk", len(chunk))
+		}
+		reassembled = append(reassembled, chunk...)
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Fatal("chunks don't add up to the original data")
+	}
+	return hashes
+}
+
+func TestChunker(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 4*1024*1024)
+	random.Read(data)
+
+	hashes := chunkHashes(t, data)
+	if average := len(data) / len(hashes); average < AVG_SIZE/2 || average > AVG_SIZE*2 {
+		t.Errorf("average chunk size is %v; expected about %v", average, AVG_SIZE)
+	}
+	if again := chunkHashes(t, data); len(again) != len(hashes) {
+		t.Error("chunking the same data twice gave different chunks")
+	}
+
+	// inserting data near the start should only change the chunks around the insertion
+	edited := append(append(append([]byte{}, data[:1000]...), []byte("some inserted bytes")...), data[1000:]...)
+	editedHashes := chunkHashes(t, edited)
+	original := map[[32]byte]bool{}
+	for _, hash := range hashes {
+		original[hash] = true
+	}
+	changed := 0
+	for _, hash := range editedHashes {
+		if !original[hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%v of %v chunks changed after inserting a few bytes; expected at most 2", changed, len(editedHashes))
+	}
+
+	if empty := chunkHashes(t, []byte{}); len(empty) != 0 {
+		t.Errorf("expected no chunks for empty data; got %v", len(empty))
+	}
+}
@@ -1,17 +1,51 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/webbben/p2p-file-share/internal/identity"
 	"github.com/webbben/p2p-file-share/internal/ui"
 )
 
 type Config struct {
 	Nickname            string `json:"nickname"`            // nickname this node will use, besides its IP address
-	SharedDirectoryPath string `json:"sharedDirectoryPath"` // the path to the shared directory that is synced among nodes for sharing files.
+	SharedDirectoryPath string `json:"sharedDirectoryPath"` // the path to the shared directory that is synced among nodes for sharing files. superseded by Shares, but still read from older configs
+	ClusterSecret       string `json:"clusterSecret"`       // secret shared by all the nodes of the share; nodes only pair with peers that know it
+	SymlinkPolicy       string `json:"symlinkPolicy"`       // how symbolic links in the shared directory are handled: "link" (default), "follow" or "ignore"
+	DisableCompression  bool   `json:"disableCompression"`  // don't compress files sent to or received from other nodes, e.g. if the network is faster than compressing them
+
+	Shares []Share `json:"shares"` // the directories this node syncs with other nodes
+
+	MaxConcurrentTransfers int      `json:"maxConcurrentTransfers"` // how many files can be received from other nodes at the same time; defaults to 3
+	PinnedPaths            []string `json:"pinnedPaths"`            // files and directories (relative to the shared directory) that are received before any others. superseded by each share's pinned paths
+
+	// limits on how fast files are sent and received. changes to these are picked up while the node is running.
+	RateLimits        RateLimits            `json:"rateLimits"`        // limits for all transfers together
+	PeerRateLimits    map[string]RateLimits `json:"peerRateLimits"`    // limits for transfers with specific peers, by peer ID
+	RateLimitSchedule []RateLimitSchedule   `json:"rateLimitSchedule"` // times of day when different limits for all transfers apply
+
+	ID      string `json:"-"` // fingerprint of this node's key; set when the config is loaded
+	ShareID string `json:"-"` // in a config scoped to a single share (see ForShare), the share's ID
+}
+
+// upload and download speed limits, in KiB per second. 0 means unlimited.
+type RateLimits struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// limits that apply during a certain time each day, e.g. full speed at night
+type RateLimitSchedule struct {
+	Start  string     `json:"start"` // time of day when the limits start to apply, e.g. "22:00"
+	End    string     `json:"end"`   // time of day when the limits stop applying, e.g. "07:00"; may be earlier than the start, to wrap past midnight
+	Limits RateLimits `json:"limits"`
 }
 
 // creates a config file if one doesn't exist yet
@@ -50,38 +84,126 @@ func LoadConfig() *Config {
 		fmt.Println("error unmarshalling config json:", err)
 		return nil
 	}
+	config.Shares = config.GetShares()
+	if id, err := LoadIdentity(config.Nickname); err != nil {
+		fmt.Println("failed to load node identity:", err)
+	} else {
+		config.ID = id.Fingerprint
+	}
 	return &config
 }
 
-func GetMountDir(config *Config) string {
-	if config != nil {
-		return config.SharedDirectoryPath
-	}
-	conf := LoadConfig()
-	return conf.SharedDirectoryPath
-}
+var (
+	nodeIdentity      *identity.Identity
+	nodeIdentityMutex sync.Mutex
+)
 
-func SaveConfig(config Config) {
-	file, err := os.Open(configFilePath())
+// loads the keypair this node identifies itself with, generating one first if the node doesn't have one yet.
+// the nickname only goes into a newly generated certificate.
+func LoadIdentity(nickname string) (*identity.Identity, error) {
+	nodeIdentityMutex.Lock()
+	defer nodeIdentityMutex.Unlock()
+
+	if nodeIdentity != nil {
+		return nodeIdentity, nil
+	}
+	id, err := identity.LoadOrCreate(DataFilePath("node.crt"), DataFilePath("node.key"), nickname)
 	if err != nil {
-		fmt.Println("failed to open config json:", err)
-		return
+		return nil, err
 	}
-	defer file.Close()
+	nodeIdentity = id
+	return id, nil
+}
 
+func SaveConfig(config Config) {
 	jsonData, err := json.Marshal(config)
 	if err != nil {
 		fmt.Println("failed to marshal config json:", err)
 		return
 	}
-	_, err = file.Write(jsonData)
-	if err != nil {
+	if err := os.WriteFile(configFilePath(), jsonData, 0644); err != nil {
 		fmt.Println("failed to write config json:", err)
 	}
 }
 
+// gets the symlink policy, falling back to syncing links as links if none (or an unknown one) is configured
+func (config Config) GetSymlinkPolicy() string {
+	switch config.SymlinkPolicy {
+	case SYMLINK_LINK, SYMLINK_FOLLOW, SYMLINK_IGNORE:
+		return config.SymlinkPolicy
+	}
+	return SYMLINK_LINK
+}
+
+// gets the cluster secret, normalized so that invite codes can be typed in with any case and grouping
+func (config Config) GetClusterSecret() string {
+	return normalizeClusterSecret(config.ClusterSecret)
+}
+
+// generates a new cluster secret, formatted as an invite code to hand out to the other nodes of the share
+func NewClusterSecret() string {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err) // the system's random number generator should never fail
+	}
+	code := hex.EncodeToString(secret)
+	groups := []string{}
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+func normalizeClusterSecret(secret string) string {
+	secret = strings.ToLower(secret)
+	return strings.NewReplacer("-", "", " ", "").Replace(secret)
+}
+
+// asks the user to either start a new share, or join an existing one with the invite code from one of its nodes.
+// returns the cluster secret of the share.
+func ClusterSecretWorkflow() string {
+	if ui.YorN("Join an existing share with an invite code?") {
+		code := ""
+		for code == "" {
+			fmt.Print("Invite code: ")
+			code = normalizeClusterSecret(ui.ReadInput())
+			if code == "" {
+				fmt.Println("You must enter an invite code.")
+			}
+		}
+		return code
+	}
+	secret := NewClusterSecret()
+	fmt.Println("Created a new share. Use this invite code to add other nodes to it:")
+	fmt.Println(secret)
+	return secret
+}
+
+// gets how many files can be received from other nodes at the same time
+func (config Config) GetMaxConcurrentTransfers() int {
+	if config.MaxConcurrentTransfers <= 0 {
+		return 3
+	}
+	return config.MaxConcurrentTransfers
+}
+
+// the ID this node uses to identify itself to other nodes, e.g. in file version vectors: the fingerprint of its key.
+// falls back to the nickname if the node's identity hasn't been loaded.
+func (config Config) NodeID() string {
+	if config.ID != "" {
+		return config.ID
+	}
+	return config.Nickname
+}
+
 func configFilePath() string {
-	return filepath.Join("internal", "config", "config.json")
+	return DataFilePath("config.json")
+}
+
+// gets the path of a file this node uses to store its own data, such as the config.
+// these files are kept outside of the shared directory so they aren't synced to other nodes.
+func DataFilePath(name string) string {
+	return filepath.Join("internal", "config", name)
 }
 
 // walks the user through creating a new config, and returns it
@@ -114,12 +236,26 @@ func NewConfigWorkflow() *Config {
 			fmt.Println("You must enter a valid directory.")
 		} else {
 			if ui.YorN(fmt.Sprintf("Path: %s.\nAre you sure you want to use this directory?", directory)) {
-				config.SharedDirectoryPath = directory
+				config.Shares = []Share{{
+					ID:   DEFAULT_SHARE_ID,
+					Name: DEFAULT_SHARE_ID,
+					Path: directory,
+				}}
 			} else {
 				fmt.Println("Gotcha, please enter a different directory then.")
 				directory = ""
 			}
 		}
 	}
+	// the share to join
+	config.ClusterSecret = ClusterSecretWorkflow()
+	// keypair, which identifies this node to other nodes from now on
+	id, err := LoadIdentity(config.Nickname)
+	if err != nil {
+		fmt.Println("failed to generate node identity:", err)
+	} else {
+		config.ID = id.Fingerprint
+		fmt.Println("Node ID:", config.ID)
+	}
 	return &config
 }
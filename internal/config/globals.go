@@ -4,8 +4,19 @@ package config
 
 const (
 	PORT int = 8080
+
+	PROTOCOL_VERSION int = 3 // version of the protocol nodes talk to each other in; nodes only pair up with peers on the same version
+
+	MAX_CONNECTIONS     int = 32    // how many incoming connections the message server handles at the same time
+	SHUTDOWN_TIMEOUT_MS int = 10000 // duration in ms to let in-progress connections finish when the node shuts down
 )
 
+// ID of the share that the shared directory of a node set up before shares existed becomes
+const DEFAULT_SHARE_ID string = "default"
+
+// hidden directory in each shared directory where files are received before being moved into place
+const STAGING_DIR string = ".p2p-staging"
+
 // message types
 const (
 	// message meant for discovering a peer node
@@ -16,9 +27,28 @@ const (
 	TYPE_FILE_CHANGE_NOTIFY string = "file_change_notify"
 	// message from a node that wants to scan this node's files
 	TYPE_SCAN_FILES string = "scan_files"
+	// message for requesting the changes to a file, rather than the whole file
+	TYPE_DELTA_REQUEST string = "delta_request"
+	// message for requesting the list of chunks a file is made of
+	TYPE_CHUNK_LIST string = "chunk_list"
+)
+
+const (
+	MESSAGE_TIMEOUT_MS      int = 1000  // duration in ms until tcp connection should timeout
+	MESSAGE_TIMEOUT_MS_LONG int = 5000  // a longer duration in ms to wait until timing out tcp connection
+	CONNECTION_IDLE_MS      int = 30000 // duration in ms an incoming connection can go without any data moving through it before it's closed
+)
+
+// symlink policies; how symbolic links in the shared directory are handled
+const (
+	SYMLINK_LINK   string = "link"   // sync links as links, pointing to the same relative target on every node
+	SYMLINK_FOLLOW string = "follow" // sync the files and directories links point to, as if they were regular files and directories
+	SYMLINK_IGNORE string = "ignore" // don't sync links at all
 )
 
+// sync modes; which way changes to a share flow between this node and its peers
 const (
-	MESSAGE_TIMEOUT_MS      int = 1000 // duration in ms until tcp connection should timeout
-	MESSAGE_TIMEOUT_MS_LONG int = 5000 // a longer duration in ms to wait until timing out tcp connection
+	SYNC_SEND_RECEIVE string = "sendreceive" // send local changes to peers, and apply changes from peers
+	SYNC_SEND_ONLY    string = "sendonly"    // send local changes to peers, but never apply changes from them; this node's copy is the authoritative one
+	SYNC_RECEIVE_ONLY string = "receiveonly" // apply changes from peers, but never send local changes to them; local changes are only flagged
 )
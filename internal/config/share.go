@@ -0,0 +1,125 @@
+package config
+
+import "strings"
+
+// a directory that is synced with other nodes. a node can have several shares, each synced with its own set of peers.
+type Share struct {
+	ID      string   `json:"id"`      // identifies the share on every node; nodes sync a share with each other if they both have a share with this ID
+	Name    string   `json:"name"`    // name of the share, for display
+	Path    string   `json:"path"`    // the directory on this node that is synced
+	Members []string `json:"members"` // IDs of the peers the share is synced with; if empty, it's synced with every paired peer
+
+	Mode      string            `json:"mode"`      // which way changes flow: "sendreceive" (default), "sendonly" or "receiveonly"
+	PeerModes map[string]string `json:"peerModes"` // modes for syncing with specific peers, by peer ID; peers not listed use the share's mode
+
+	PinnedPaths []string `json:"pinnedPaths"` // files and directories (relative to the share's directory) that are received before any others
+}
+
+// whether the share is synced with the peer with the given ID
+func (share Share) HasMember(peerID string) bool {
+	if len(share.Members) == 0 {
+		return true
+	}
+	for _, member := range share.Members {
+		if strings.EqualFold(member, peerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// gets the sync mode of the share with the given peer, falling back to the share's own mode if there's none (or an unknown one) for the peer.
+// if peerID is empty, gets the share's own mode.
+func (share Share) GetSyncMode(peerID string) string {
+	if mode, exists := share.PeerModes[peerID]; exists && peerID != "" && isSyncMode(mode) {
+		return mode
+	}
+	if isSyncMode(share.Mode) {
+		return share.Mode
+	}
+	return SYNC_SEND_RECEIVE
+}
+
+// whether local changes to the share are sent to any peer, i.e. the share isn't receive-only with every peer.
+// a receive-only share still sends its changes to the peers it has a different mode with.
+func (share Share) SendsChanges() bool {
+	if share.GetSyncMode("") != SYNC_RECEIVE_ONLY {
+		return true
+	}
+	for peerID := range share.PeerModes {
+		if share.GetSyncMode(peerID) != SYNC_RECEIVE_ONLY {
+			return true
+		}
+	}
+	return false
+}
+
+func isSyncMode(mode string) bool {
+	switch mode {
+	case SYNC_SEND_RECEIVE, SYNC_SEND_ONLY, SYNC_RECEIVE_ONLY:
+		return true
+	}
+	return false
+}
+
+// gets the shares of this node. a config from before shares existed has a single share: the shared directory.
+func (config Config) GetShares() []Share {
+	if len(config.Shares) == 0 && config.SharedDirectoryPath != "" {
+		return []Share{{
+			ID:          DEFAULT_SHARE_ID,
+			Name:        DEFAULT_SHARE_ID,
+			Path:        config.SharedDirectoryPath,
+			PinnedPaths: config.PinnedPaths,
+		}}
+	}
+	return config.Shares
+}
+
+// finds a share by its ID
+func (config Config) GetShare(id string) (Share, bool) {
+	for _, share := range config.GetShares() {
+		if share.ID == id {
+			return share, true
+		}
+	}
+	return Share{}, false
+}
+
+// gets a copy of the config scoped to a single share: its shared directory and pinned paths are the share's.
+// functions that work on a single shared directory take a scoped config.
+func (config Config) ForShare(share Share) Config {
+	config.ShareID = share.ID
+	config.SharedDirectoryPath = share.Path
+	config.PinnedPaths = share.PinnedPaths
+	return config
+}
+
+// whether the share a config is scoped to is synced with the peer with the given ID.
+// an unscoped config is synced with every peer.
+func (config Config) IsShareMember(peerID string) bool {
+	if config.ShareID == "" {
+		return true
+	}
+	share, exists := config.GetShare(config.ShareID)
+	return exists && share.HasMember(peerID)
+}
+
+// gets the sync mode of the share a config is scoped to, with the given peer (see Share.GetSyncMode).
+// an unscoped config syncs both ways.
+func (config Config) GetSyncMode(peerID string) string {
+	share, exists := config.GetShare(config.ShareID)
+	if config.ShareID == "" || !exists {
+		return SYNC_SEND_RECEIVE
+	}
+	return share.GetSyncMode(peerID)
+}
+
+// whether local changes to the share a config is scoped to are sent to any peer (see Share.SendsChanges).
+// an unscoped config sends them to every peer.
+func (config Config) SendsChanges() bool {
+	share, exists := config.GetShare(config.ShareID)
+	if config.ShareID == "" || !exists {
+		return true
+	}
+	return share.SendsChanges()
+}
@@ -0,0 +1,331 @@
+package filetransfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/webbben/p2p-file-share/internal/chunker"
+	"github.com/webbben/p2p-file-share/internal/config"
+	"github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/network"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+// finds a chunk that is already somewhere in the local shared directory.
+// returns the full path of a file containing the chunk, and where in that file it is.
+type ChunkLocator func(hash string) (string, int64, bool)
+
+// chunks that are missing locally are requested together with their neighbours, up to this many bytes at a time.
+// small enough that a file's ranges can be spread over several peers.
+const maxRangeLength = 4 * 1024 * 1024
+
+// sends another node the header describing a file and the chunks it's made of; or an error message if there's no such file
+func SendChunkList(conn net.Conn, filePath string, header *model.FileTransferHeader) (bool, error) {
+	defer conn.Close()
+
+	if header == nil {
+		network.WriteError(conn, "no chunk list for file: "+filePath)
+		return false, fmt.Errorf("no chunk list for file: %s", filePath)
+	}
+	if err := writeHeader(conn, *header); err != nil {
+		fmt.Println("Error sending chunk list:", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// requests a file from other nodes, like RequestFile, but only transfers the chunks of the file that aren't already somewhere in the shared directory.
+// the chunks that are found locally are copied from wherever they are.
+//
+// the first node is the one we know has the version we want. every other node that has the exact same file helps send the missing chunks,
+// each node sending different parts of the file at the same time.
+//
+// if the first node can't tell us which chunks the file is made of, or an earlier transfer of it can be resumed, the file is requested from it with RequestFileDelta instead.
+func RequestFileChunks(senders []model.Peer, conf config.Config, filePath string, minVersion model.VersionVector, locate ChunkLocator, beforeCommit BeforeCommit) (*model.FileTransferHeader, error) {
+	if len(senders) == 0 {
+		return nil, errors.New("no nodes to request the file from")
+	}
+	mountDir := conf.SharedDirectoryPath
+	if _, err := util.SafeJoin(mountDir, filePath, config.STAGING_DIR); err != nil {
+		return nil, err
+	}
+	if offset, _ := stagedProgress(mountDir, filePath); offset > 0 {
+		return RequestFile(senders[0], conf, filePath, minVersion, beforeCommit)
+	}
+	headers := requestChunkLists(senders, conf.ShareID, filePath)
+	header := headers[0]
+	if header == nil || (len(header.Chunks) == 0 && header.Size > 0) {
+		fmt.Printf("no chunk list for %s; requesting changes instead\n", filePath)
+		return RequestFileDelta(senders[0], conf, filePath, minVersion, beforeCommit)
+	}
+	if err := checkChunkList(header); err != nil {
+		return nil, fmt.Errorf("%w: bad chunk list for %s: %s", ErrVerificationFailed, filePath, err)
+	}
+	if err := checkVersion(header, filePath, minVersion); err != nil {
+		return nil, err
+	}
+	swarm := []model.Peer{senders[0]}
+	for i, other := range headers[1:] {
+		if other != nil && other.Hash == header.Hash {
+			swarm = append(swarm, senders[i+1])
+		}
+	}
+
+	stagedHeader := *header
+	stagedHeader.Chunks = nil
+	// chunks are written wherever they go in the file as they arrive, so if this is cut off, it has to start over
+	file, err := openStaged(mountDir, filePath, &stagedHeader, true)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	missing := copyLocalChunks(file, header.Chunks, locate)
+	fmt.Printf("found %v of %v chunks of %s locally; requesting the rest from %v node(s)\n", len(header.Chunks)-len(missing), len(header.Chunks), filePath, len(swarm))
+	if err := downloadRanges(swarm, conf, filePath, header.Hash, chunkRanges(missing), file); err != nil {
+		// the chunks received so far aren't necessarily a prefix of the file, so they can't be resumed
+		discardStaged(mountDir, filePath)
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	received, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := commitStaged(file, mountDir, filePath, &stagedHeader, received, hash, beforeCommit); err != nil {
+		return nil, err
+	}
+	fmt.Println("received file:", filePath, header.Version)
+	return header, nil
+}
+
+// asks each node which chunks its copy of a file is made of, all at the same time.
+// returns the nodes' replies in the same order as the nodes; nil for nodes that didn't reply.
+func requestChunkLists(senders []model.Peer, shareID string, filePath string) []*model.FileTransferHeader {
+	headers := make([]*model.FileTransferHeader, len(senders))
+	var wg sync.WaitGroup
+	for i, sender := range senders {
+		wg.Add(1)
+		go func(i int, sender model.Peer) {
+			defer wg.Done()
+			header, err := requestChunkList(sender, shareID, filePath)
+			if err != nil {
+				fmt.Printf("failed to get chunk list of %s from %s: %s\n", filePath, sender.IP, err)
+				return
+			}
+			headers[i] = header
+		}(i, sender)
+	}
+	wg.Wait()
+	return headers
+}
+
+// downloads ranges of a file from several nodes at once, and writes them to the staged file.
+// each node downloads one range at a time; if a node fails, its range is handed to the others.
+func downloadRanges(senders []model.Peer, conf config.Config, filePath string, fileHash string, ranges []chunkRange, file *os.File) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	type result struct {
+		r      chunkRange
+		sender model.Peer
+		err    error
+	}
+	jobs := make(chan chunkRange, len(ranges))
+	results := make(chan result, len(ranges)+len(senders))
+	for _, r := range ranges {
+		jobs <- r
+	}
+	for _, sender := range senders {
+		go func(sender model.Peer) {
+			for r := range jobs {
+				err := requestRange(sender, conf, filePath, fileHash, r, file)
+				results <- result{r, sender, err}
+				if err != nil {
+					return // stop asking a node that's failing
+				}
+			}
+		}(sender)
+	}
+	defer close(jobs)
+
+	pending, working := len(ranges), len(senders)
+	for pending > 0 {
+		res := <-results
+		if res.err == nil {
+			pending--
+			continue
+		}
+		fmt.Printf("failed to get part of %s from %s: %s\n", filePath, res.sender.IP, res.err)
+		working--
+		if working == 0 {
+			return res.err
+		}
+		jobs <- res.r
+	}
+	return nil
+}
+
+// asks another node which chunks a file is made of
+func requestChunkList(sender model.Peer, shareID string, filePath string) (*model.FileTransferHeader, error) {
+	conn, err := network.DialPeer(sender.IP, sender.ID, port, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = network.WriteMessage(conn, model.FileRequest{
+		Type:  config.TYPE_CHUNK_LIST,
+		Share: shareID,
+		File:  filePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readHeader(conn, bufio.NewReader(conn))
+}
+
+// checks that the chunk list a node sent describes the whole file it announced, and nothing else: the chunks have to follow each other from
+// the start of the file, without gaps or overlaps, each no bigger than a chunk can be, and add up to the size of the file.
+// the chunks decide how much is read and where it's written, so a list that doesn't add up is never used.
+func checkChunkList(header *model.FileTransferHeader) error {
+	var offset int64
+	for _, chunk := range header.Chunks {
+		if chunk.Offset != offset {
+			return fmt.Errorf("chunk at %v should be at %v", chunk.Offset, offset)
+		}
+		if chunk.Length <= 0 || chunk.Length > int64(chunker.MAX_SIZE) {
+			return fmt.Errorf("chunk at %v has invalid length %v", chunk.Offset, chunk.Length)
+		}
+		offset += chunk.Length
+	}
+	if offset != header.Size {
+		return fmt.Errorf("chunks add up to %v bytes, but the file has %v", offset, header.Size)
+	}
+	return nil
+}
+
+// copies the chunks that can be found locally into the staged file, and returns the ones that couldn't be found
+func copyLocalChunks(file *os.File, chunks []model.Chunk, locate ChunkLocator) []model.Chunk {
+	missing := []model.Chunk{}
+	for _, chunk := range chunks {
+		if !copyLocalChunk(file, chunk, locate) {
+			missing = append(missing, chunk)
+		}
+	}
+	return missing
+}
+
+func copyLocalChunk(file *os.File, chunk model.Chunk, locate ChunkLocator) bool {
+	if locate == nil {
+		return false
+	}
+	fullPath, offset, found := locate(chunk.Hash)
+	if !found {
+		return false
+	}
+	source, err := os.Open(fullPath)
+	if err != nil {
+		return false
+	}
+	defer source.Close()
+	data := make([]byte, chunk.Length)
+	if _, err := source.ReadAt(data, offset); err != nil {
+		return false
+	}
+	// the file may have changed since it was indexed
+	if hashChunk(data) != chunk.Hash {
+		return false
+	}
+	_, err = file.WriteAt(data, chunk.Offset)
+	return err == nil
+}
+
+// a range of a file, made of consecutive chunks
+type chunkRange struct {
+	offset int64
+	length int64
+	chunks []model.Chunk
+}
+
+// groups consecutive chunks into ranges, so neighbouring chunks can be requested together
+func chunkRanges(chunks []model.Chunk) []chunkRange {
+	ranges := []chunkRange{}
+	for _, chunk := range chunks {
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if last.offset+last.length == chunk.Offset && last.length+chunk.Length <= maxRangeLength {
+				last.length += chunk.Length
+				last.chunks = append(last.chunks, chunk)
+				continue
+			}
+		}
+		ranges = append(ranges, chunkRange{chunk.Offset, chunk.Length, []model.Chunk{chunk}})
+	}
+	return ranges
+}
+
+// requests a range of a file from another node, verifies each chunk in it, and writes it to the staged file
+func requestRange(sender model.Peer, conf config.Config, filePath string, fileHash string, r chunkRange, file *os.File) error {
+	conn, err := network.DialPeer(sender.IP, sender.ID, port, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = network.WriteMessage(conn, model.FileRequest{
+		Type:   config.TYPE_FILE_REQUEST,
+		Share:  conf.ShareID,
+		File:   filePath,
+		Offset: r.offset,
+		Length: r.length,
+		Hash:   fileHash,
+
+		Compression: acceptedCompression(conf),
+	})
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	header, err := readHeader(conn, reader)
+	if err != nil {
+		return err
+	}
+	// the sender only sends the range if it still has the same contents
+	if header.Hash != fileHash || header.Offset != r.offset || header.Length != r.length {
+		return errors.New("sender's copy of the file has changed")
+	}
+	contents, err := contentsReader(conn, reader, header)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range r.chunks {
+		data := make([]byte, chunk.Length)
+		if _, err := io.ReadFull(contents, data); err != nil {
+			return err
+		}
+		if hashChunk(data) != chunk.Hash {
+			return fmt.Errorf("%w: chunk at %v of %s doesn't match its hash", ErrVerificationFailed, chunk.Offset, filePath)
+		}
+		if _, err := file.WriteAt(data, chunk.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashChunk(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
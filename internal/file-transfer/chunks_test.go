@@ -0,0 +1,41 @@
+package filetransfer
+
+import (
+	"testing"
+
+	"github.com/webbben/p2p-file-share/internal/chunker"
+	"github.com/webbben/p2p-file-share/internal/model"
+)
+
+func TestCheckChunkList(t *testing.T) {
+	max := int64(chunker.MAX_SIZE)
+	valid := map[string]model.FileTransferHeader{
+		"empty file": {Size: 0},
+		"one chunk":  {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 10}}},
+		"many chunks": {Size: max + 5, Chunks: []model.Chunk{
+			{Offset: 0, Length: max},
+			{Offset: max, Length: 5},
+		}},
+	}
+	for name, header := range valid {
+		if err := checkChunkList(&header); err != nil {
+			t.Errorf("%s: chunk list should be accepted: %s", name, err)
+		}
+	}
+
+	invalid := map[string]model.FileTransferHeader{
+		"negative length": {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: -10}, {Offset: -10, Length: 20}}},
+		"empty chunk":     {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 0}, {Offset: 0, Length: 10}}},
+		"huge chunk":      {Size: max + 1, Chunks: []model.Chunk{{Offset: 0, Length: max + 1}}},
+		"gap":             {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 5}, {Offset: 6, Length: 4}}},
+		"overlap":         {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 5}, {Offset: 4, Length: 6}}},
+		"past the end":    {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 10}, {Offset: 10, Length: 5}}},
+		"short":           {Size: 10, Chunks: []model.Chunk{{Offset: 0, Length: 5}}},
+		"not from start":  {Size: 10, Chunks: []model.Chunk{{Offset: 1 << 40, Length: 10}}},
+	}
+	for name, header := range invalid {
+		if err := checkChunkList(&header); err == nil {
+			t.Errorf("%s: chunk list should be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package filetransfer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/webbben/p2p-file-share/internal/config"
+)
+
+// compression formats file contents can be sent in
+const (
+	COMPRESSION_GZIP string = "gzip"
+)
+
+// ranges smaller than this aren't worth compressing
+const minCompressLength = 4 * 1024
+
+// file formats that are already compressed, and won't get any smaller
+var compressedExtensions = map[string]bool{
+	".7z": true, ".bz2": true, ".gz": true, ".tgz": true, ".xz": true, ".zip": true, ".zst": true, ".rar": true, ".lz4": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true, ".jar": true, ".apk": true,
+}
+
+// gets the compression formats this node accepts when receiving files
+func acceptedCompression(conf config.Config) []string {
+	if conf.DisableCompression {
+		return nil
+	}
+	return []string{COMPRESSION_GZIP}
+}
+
+// picks the compression format to send (part of) a file in, out of the ones the receiver accepts. returns "" for no compression.
+func chooseCompression(conf config.Config, accepted []string, filePath string, length int64) string {
+	if length < minCompressLength || compressedExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		return ""
+	}
+	if !slices.Contains(accepted, COMPRESSION_GZIP) || conf.DisableCompression {
+		return ""
+	}
+	return COMPRESSION_GZIP
+}
+
+// wraps a writer so everything written to it is compressed in the given format. the returned writer must be closed to finish the compressed stream.
+func compressWriter(w io.Writer, compression string) io.WriteCloser {
+	if compression == COMPRESSION_GZIP {
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed) // only fails for invalid levels
+		return gz
+	}
+	return nopWriteCloser{w}
+}
+
+// wraps a reader so everything read from it is decompressed from the given format
+func decompressReader(r io.Reader, compression string) (io.Reader, error) {
+	switch compression {
+	case "":
+		return r, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
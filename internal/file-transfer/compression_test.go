@@ -0,0 +1,60 @@
+package filetransfer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/webbben/p2p-file-share/internal/config"
+)
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat("some very compressible log line\n", 1000))
+	accepted := []string{COMPRESSION_GZIP}
+
+	if compression := chooseCompression(config.Config{}, accepted, "logs/app.log", int64(len(data))); compression != COMPRESSION_GZIP {
+		t.Errorf("expected a text file to be compressed; got %q", compression)
+	}
+	if compression := chooseCompression(config.Config{}, accepted, "photos/IMG_0001.JPG", int64(len(data))); compression != "" {
+		t.Errorf("expected an already compressed file not to be compressed; got %q", compression)
+	}
+	if compression := chooseCompression(config.Config{}, accepted, "tiny.txt", 10); compression != "" {
+		t.Errorf("expected a tiny range not to be compressed; got %q", compression)
+	}
+	if compression := chooseCompression(config.Config{}, nil, "logs/app.log", int64(len(data))); compression != "" {
+		t.Errorf("expected no compression when the receiver doesn't accept any; got %q", compression)
+	}
+	if compression := chooseCompression(config.Config{DisableCompression: true}, accepted, "logs/app.log", int64(len(data))); compression != "" {
+		t.Errorf("expected no compression when it's disabled; got %q", compression)
+	}
+	if accepted := acceptedCompression(config.Config{DisableCompression: true}); len(accepted) != 0 {
+		t.Errorf("expected no compression to be accepted when it's disabled; got %v", accepted)
+	}
+
+	var wire bytes.Buffer
+	w := compressWriter(&wire, COMPRESSION_GZIP)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Len() >= len(data)/2 {
+		t.Errorf("compressed %v bytes to %v bytes; expected it to be much smaller", len(data), wire.Len())
+	}
+	r, err := decompressReader(&wire, COMPRESSION_GZIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Error("decompressed data doesn't match the original")
+	}
+	if _, err := decompressReader(&wire, "lzma"); err == nil {
+		t.Error("expected an error for an unsupported compression format")
+	}
+}
@@ -0,0 +1,376 @@
+package filetransfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+
+	"github.com/webbben/p2p-file-share/internal/config"
+	"github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/network"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+/*
+Delta transfers, in the style of rsync:
+
+the receiver splits its current copy of a file into blocks, and sends the sender a signature of each block: a weak rolling checksum and a strong hash.
+the sender slides a window over its own copy of the file, looking for blocks the receiver already has. it replies with a stream of instructions:
+copy a block the receiver already has, or write some literal bytes the receiver doesn't have. the receiver rebuilds the file from those instructions.
+*/
+
+// delta instructions; each is a one byte opcode followed by its arguments
+const (
+	deltaCopy    byte = 'C' // followed by a uint32 block index: copy that block from the receiver's current copy
+	deltaLiteral byte = 'L' // followed by a uint32 length and that many bytes: write the bytes as they are
+	deltaEnd     byte = 'E' // the end of the instructions
+)
+
+const (
+	minBlockSize     = 2 * 1024
+	maxBlockSize     = 128 * 1024
+	maxLiteralLength = 64 * 1024 // literal bytes are sent in pieces of at most this size
+)
+
+// picks the block size for a file of the given size; about the square root of the size, like rsync does,
+// so big files don't need huge lists of signatures and small files can still share most of their blocks
+func deltaBlockSize(fileSize int64) int {
+	blockSize := int(math.Sqrt(float64(fileSize)))
+	blockSize -= blockSize % 1024
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+// computes the weak rolling checksum of a block
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a, b
+}
+
+func weakDigest(a, b uint32) uint32 {
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+func strongHash(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// computes the signatures of each block of a file
+func computeSignatures(r io.Reader, blockSize int) ([]model.BlockSignature, error) {
+	signatures := []model.BlockSignature{}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			a, b := weakChecksum(block[:n])
+			signatures = append(signatures, model.BlockSignature{
+				Weak:   weakDigest(a, b),
+				Strong: strongHash(block[:n]),
+			})
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return signatures, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// computes the instructions for turning a file with the given block signatures into the file read from r, and writes them to w
+func computeDelta(r io.Reader, signatures []model.BlockSignature, blockSize int, w io.Writer) error {
+	// index the blocks by their weak checksum, so most windows can be ruled out without computing the strong hash
+	blocks := map[uint32][]int{}
+	for i, signature := range signatures {
+		blocks[signature.Weak] = append(blocks[signature.Weak], i)
+	}
+	findBlock := func(window []byte, a, b uint32) int {
+		candidates := blocks[weakDigest(a, b)]
+		if len(candidates) == 0 {
+			return -1
+		}
+		hash := strongHash(window)
+		for _, i := range candidates {
+			if signatures[i].Strong == hash {
+				return i
+			}
+		}
+		return -1
+	}
+
+	reader := bufio.NewReader(r)
+	out := bufio.NewWriter(w)
+	literal := make([]byte, 0, maxLiteralLength)
+	flushLiteral := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		if err := writeLiteral(out, literal); err != nil {
+			return err
+		}
+		literal = literal[:0]
+		return nil
+	}
+	// fills the window up to the block size, and computes its checksum from scratch
+	fillWindow := func(window []byte) ([]byte, uint32, uint32, error) {
+		window = window[:0]
+		for len(window) < blockSize {
+			c, err := reader.ReadByte()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			window = append(window, c)
+		}
+		a, b := weakChecksum(window)
+		return window, a, b, nil
+	}
+
+	window, a, b, err := fillWindow(make([]byte, 0, blockSize))
+	if err != nil {
+		return err
+	}
+	for len(window) > 0 {
+		if i := findBlock(window, a, b); i >= 0 {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			if err := writeCopy(out, i); err != nil {
+				return err
+			}
+			if window, a, b, err = fillWindow(window); err != nil {
+				return err
+			}
+			continue
+		}
+		// no match; the first byte of the window has to be sent as is, and the window moves on by one byte
+		first := window[0]
+		literal = append(literal, first)
+		if len(literal) == maxLiteralLength {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+		length := uint32(len(window))
+		a -= uint32(first)
+		b -= length * uint32(first)
+		window = window[1:]
+		c, err := reader.ReadByte()
+		if err == nil {
+			window = append(window, c)
+			a += uint32(c)
+			b += a
+		} else if !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	if err := flushLiteral(); err != nil {
+		return err
+	}
+	if err := out.WriteByte(deltaEnd); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func writeCopy(w *bufio.Writer, block int) error {
+	if err := w.WriteByte(deltaCopy); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, uint32(block))
+}
+
+func writeLiteral(w *bufio.Writer, data []byte) error {
+	if err := w.WriteByte(deltaLiteral); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// rebuilds a file from delta instructions, copying blocks from base (the receiver's current copy of the file) and writing the result to out.
+// returns the number of bytes written.
+func applyDelta(base io.ReaderAt, baseSize int64, blockSize int, delta io.Reader, out io.Writer) (int64, error) {
+	reader := bufio.NewReader(delta)
+	block := make([]byte, blockSize)
+	var written int64
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return written, errors.Join(errors.New("delta instructions ended unexpectedly"), err)
+		}
+		var arg uint32
+		if op == deltaCopy || op == deltaLiteral {
+			if err := binary.Read(reader, binary.BigEndian, &arg); err != nil {
+				return written, err
+			}
+		}
+		switch op {
+		case deltaCopy:
+			offset := int64(arg) * int64(blockSize)
+			if offset >= baseSize {
+				return written, fmt.Errorf("delta refers to block %v, which doesn't exist", arg)
+			}
+			n, err := base.ReadAt(block[:min(int64(blockSize), baseSize-offset)], offset)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return written, err
+			}
+			if _, err := out.Write(block[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		case deltaLiteral:
+			if arg > maxLiteralLength {
+				return written, fmt.Errorf("delta literal of %v bytes is too long", arg)
+			}
+			n, err := io.CopyN(out, reader, int64(arg))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case deltaEnd:
+			return written, nil
+		default:
+			return written, fmt.Errorf("unknown delta instruction: %q", op)
+		}
+	}
+}
+
+// sends the changes to a file that another node has an older copy of, preceded by a header describing the version of the file being sent.
+// indexed is what the index knows about the file, if anything; see openFileToSend.
+func SendFileDelta(conn net.Conn, conf config.Config, req model.DeltaRequest, version model.VersionVector, indexed *model.FileTransferHeader) (bool, error) {
+	defer conn.Close()
+
+	if req.BlockSize < minBlockSize || req.BlockSize > maxBlockSize {
+		network.WriteError(conn, fmt.Sprintf("invalid block size: %v", req.BlockSize))
+		return false, fmt.Errorf("invalid block size: %v", req.BlockSize)
+	}
+	file, info, fileHash, err := openFileToSend(conn, conf.SharedDirectoryPath, req.File, indexed)
+	if err != nil {
+		fmt.Println("Error sending file delta:", err)
+		return false, err
+	}
+	defer file.Close()
+
+	compression := chooseCompression(conf, req.Compression, req.File, info.Size())
+	err = writeHeader(conn, model.FileTransferHeader{
+		File:        req.File,
+		Version:     version,
+		Mode:        info.Mode(),
+		ModTime:     info.ModTime(),
+		Size:        info.Size(),
+		Hash:        fileHash,
+		Length:      info.Size(),
+		Compression: compression,
+	})
+	if err != nil {
+		fmt.Println("Error sending file delta:", err)
+		return false, err
+	}
+	out := contentsWriter(conn, compression)
+	err = computeDelta(io.LimitReader(file, info.Size()), req.Signatures, req.BlockSize, out)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Println("Error sending file delta:", err)
+		return false, err
+	}
+	fmt.Println("File delta sent successfully!")
+	return true, nil
+}
+
+// requests a file from another node, like RequestFile, but only has the node send the parts of the file that differ from our current copy.
+//
+// if we don't have a copy of the file, or an earlier transfer of it can be resumed, the whole file is requested instead.
+func RequestFileDelta(sender model.Peer, conf config.Config, filePath string, minVersion model.VersionVector, beforeCommit BeforeCommit) (*model.FileTransferHeader, error) {
+	mountDir := conf.SharedDirectoryPath
+	fullPath, err := util.SafeJoin(mountDir, filePath, config.STAGING_DIR)
+	if err != nil {
+		return nil, err
+	}
+	base, err := os.Open(fullPath)
+	if err != nil {
+		return RequestFile(sender, conf, filePath, minVersion, beforeCommit)
+	}
+	defer base.Close()
+	info, err := base.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return RequestFile(sender, conf, filePath, minVersion, beforeCommit)
+	}
+	if offset, _ := stagedProgress(mountDir, filePath); offset > 0 {
+		return RequestFile(sender, conf, filePath, minVersion, beforeCommit)
+	}
+
+	blockSize := deltaBlockSize(info.Size())
+	signatures, err := computeSignatures(io.LimitReader(base, info.Size()), blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the sender node
+	conn, err := network.DialPeer(sender.IP, sender.ID, port, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = network.WriteMessage(conn, model.DeltaRequest{
+		Type:       config.TYPE_DELTA_REQUEST,
+		Share:      conf.ShareID,
+		File:       filePath,
+		BlockSize:  blockSize,
+		Signatures: signatures,
+
+		Compression: acceptedCompression(conf),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, err := readHeader(conn, reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(header, filePath, minVersion); err != nil {
+		return nil, err
+	}
+
+	// rebuild the new version in the staging area. it's a prefix of the whole file, so if the transfer is cut off, it can be resumed with RequestFile.
+	file, err := openStaged(mountDir, filePath, header, false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	delta, err := contentsReader(conn, reader, header)
+	if err != nil {
+		return nil, err
+	}
+	b, err := applyDelta(base, info.Size(), blockSize, delta, io.MultiWriter(file, hash))
+	if err != nil {
+		return nil, err
+	}
+	if err := commitStaged(file, mountDir, filePath, header, b, hash, beforeCommit); err != nil {
+		return nil, err
+	}
+	fmt.Printf("rebuilt %s from delta (%v bytes)\n", filePath, b)
+	return header, nil
+}
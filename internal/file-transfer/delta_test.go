@@ -0,0 +1,101 @@
+package filetransfer
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		random.Read(b)
+		return b
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	base := randomBytes(100_000)
+	blockSize := deltaBlockSize(int64(len(base)))
+
+	tests := []struct {
+		name       string
+		base       []byte
+		target     []byte
+		maxLiteral int // most literal bytes the delta should need
+	}{
+		{"unchanged", base, base, 0},
+		{"byte changed", base, concat(base[:50_000], []byte{base[50_000] + 1}, base[50_001:]), 2 * blockSize},
+		{"bytes inserted", base, concat(base[:30_000], []byte("inserted"), base[30_000:]), 2 * blockSize},
+		{"bytes removed", base, concat(base[:30_000], base[30_100:]), 2 * blockSize},
+		{"appended", base, concat(base, randomBytes(1000)), 1000 + blockSize},
+		{"truncated", base, base[:12_345], blockSize},
+		{"empty target", base, []byte{}, 0},
+		{"empty base", []byte{}, base, len(base)},
+		{"unrelated", base, randomBytes(5000), 5000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signatures, err := computeSignatures(bytes.NewReader(test.base), blockSize)
+			if err != nil {
+				t.Fatal("failed to compute signatures:", err)
+			}
+			var delta bytes.Buffer
+			if err := computeDelta(bytes.NewReader(test.target), signatures, blockSize, &delta); err != nil {
+				t.Fatal("failed to compute delta:", err)
+			}
+			literal := literalBytes(t, delta.Bytes())
+			if literal > test.maxLiteral {
+				t.Errorf("delta sends %v literal bytes; expected at most %v", literal, test.maxLiteral)
+			}
+
+			var out bytes.Buffer
+			n, err := applyDelta(bytes.NewReader(test.base), int64(len(test.base)), blockSize, &delta, &out)
+			if err != nil {
+				t.Fatal("failed to apply delta:", err)
+			}
+			if n != int64(len(test.target)) || !bytes.Equal(out.Bytes(), test.target) {
+				t.Errorf("rebuilt file doesn't match the target (got %v bytes, expected %v)", n, len(test.target))
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsBadInstructions(t *testing.T) {
+	base := []byte("some base file contents")
+	tests := map[string][]byte{
+		"missing end":        {deltaLiteral, 0, 0, 0, 1, 'x'},
+		"block out of range": {deltaCopy, 0, 0, 0, 5, deltaEnd},
+		"unknown op":         {'?', deltaEnd},
+	}
+	for name, delta := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := applyDelta(bytes.NewReader(base), int64(len(base)), minBlockSize, bytes.NewReader(delta), &out); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// counts the literal bytes in a delta
+func literalBytes(t *testing.T, delta []byte) int {
+	total := 0
+	for i := 0; i < len(delta); {
+		switch delta[i] {
+		case deltaCopy:
+			i += 5
+		case deltaLiteral:
+			length := int(delta[i+1])<<24 | int(delta[i+2])<<16 | int(delta[i+3])<<8 | int(delta[i+4])
+			total += length
+			i += 5 + length
+		case deltaEnd:
+			return total
+		default:
+			t.Fatalf("unknown delta instruction at %v: %q", i, delta[i])
+		}
+	}
+	t.Fatal("delta has no end instruction")
+	return total
+}
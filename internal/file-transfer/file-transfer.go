@@ -2,39 +2,85 @@
 package filetransfer
 
 import (
-	"encoding/json"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/webbben/p2p-file-share/internal/config"
 	"github.com/webbben/p2p-file-share/internal/model"
 	"github.com/webbben/p2p-file-share/internal/network"
+	"github.com/webbben/p2p-file-share/internal/ratelimit"
+	"github.com/webbben/p2p-file-share/internal/util"
 )
 
-const (
-	port = 8080
-)
+const port = 8080
+
+// the received file isn't the file the sender announced, e.g. because the connection dropped partway through
+var ErrVerificationFailed = errors.New("received file failed verification")
 
-// sends a file to another node
-func SendFile(conn net.Conn, filePath string) (bool, error) {
+// called with the full path of a received file once it has been verified, right before it replaces the current copy of the file.
+// this is the last chance to do something with the current copy, like keeping it under a different name. if it fails, the received file isn't moved into place.
+type BeforeCommit func(fullPath string) error
+
+// sends a file from a share to another node, preceded by a header describing the version of the file being sent.
+// takes a config scoped to the share (see config.ForShare). if the request asks for a range of the file, only that range is sent.
+// indexed is what the index knows about the file, if anything; see openFileToSend.
+func SendFile(conn net.Conn, conf config.Config, req model.FileRequest, version model.VersionVector, indexed *model.FileTransferHeader) (bool, error) {
 	defer conn.Close()
 
-	mountDir := config.GetMountDir(nil) // TODO pass config in instead of loading it
-	// open the file
-	file, err := os.Open(filepath.Join(mountDir, filePath))
+	filePath := req.File
+	file, info, fileHash, err := openFileToSend(conn, conf.SharedDirectoryPath, filePath, indexed)
 	if err != nil {
-		_, err := conn.Write([]byte("ERROR: Failed to open file: " + filePath))
 		fmt.Println("Error sending file:", err)
 		return false, err
 	}
 	defer file.Close()
 
-	// send the file
-	_, err = io.Copy(conn, file)
+	// work out which part of the file to send. a range for different contents than the file has now is no use to the receiver.
+	offset, length := int64(0), info.Size()
+	if (req.Hash == "" || req.Hash == fileHash) && req.Offset >= 0 && req.Offset <= info.Size() {
+		offset = req.Offset
+		length = info.Size() - offset
+		if req.Length > 0 && req.Length < length {
+			length = req.Length
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		fmt.Println("Error sending file:", err)
+		return false, err
+	}
+
+	compression := chooseCompression(conf, req.Compression, filePath, length)
+	err = writeHeader(conn, model.FileTransferHeader{
+		File:        filePath,
+		Version:     version,
+		Mode:        info.Mode(),
+		ModTime:     info.ModTime(),
+		Size:        info.Size(),
+		Hash:        fileHash,
+		Offset:      offset,
+		Length:      length,
+		Compression: compression,
+	})
+	if err != nil {
+		fmt.Println("Error sending file:", err)
+		return false, err
+	}
+
+	// send the file; exactly the bytes that were hashed, even if the file has grown since
+	out := contentsWriter(conn, compression)
+	_, err = io.CopyN(out, file, length)
+	if err == nil {
+		err = out.Close()
+	}
 	if err != nil {
 		fmt.Println("Error sending file:", err)
 		return false, err
@@ -43,73 +89,284 @@ func SendFile(conn net.Conn, filePath string) (bool, error) {
 	return true, nil
 }
 
-// requests a file from another node
-func RequestFile(senderIP string, filePath string) (bool, error) {
+// opens a file to send to another node, and gets the hash of its contents so the receiver can verify what it gets.
+// the hash is taken from the index if the file's size and modification time still match what was indexed; otherwise the file is hashed up front.
+// that way a file that is requested a range at a time isn't read in full for every range.
+// if the file can't be opened, the receiver is sent an error message.
+func openFileToSend(conn net.Conn, mountDir string, filePath string, indexed *model.FileTransferHeader) (*os.File, os.FileInfo, string, error) {
+	fullPath, err := util.SafeJoin(mountDir, filePath, config.STAGING_DIR)
+	if err != nil {
+		network.WriteError(conn, "invalid file path: "+filePath)
+		return nil, nil, "", err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		network.WriteError(conn, "failed to open file: "+filePath)
+		return nil, nil, "", err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	if indexed != nil && indexed.Hash != "" && indexed.Size == info.Size() && indexed.ModTime.Equal(info.ModTime()) {
+		return file, info, indexed.Hash, nil
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, info.Size()); err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	return file, info, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sends the header as a message frame, ahead of the file contents
+func writeHeader(conn net.Conn, header model.FileTransferHeader) error {
+	return network.WriteMessage(conn, header)
+}
+
+// wraps a connection for sending file contents: compressed in the given format, rate limited, and split into data frames.
+// closing the writer finishes the contents, but leaves the connection open.
+func contentsWriter(conn net.Conn, compression string) io.WriteCloser {
+	frames := network.NewDataWriter(limitUpload(conn))
+	return contentsCloser{compressWriter(frames, compression), frames}
+}
+
+type contentsCloser struct {
+	io.WriteCloser
+	frames io.WriteCloser
+}
+
+func (c contentsCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.frames.Close()
+}
+
+// reads the file contents that follow a header, undoing what contentsWriter did
+func contentsReader(conn net.Conn, reader *bufio.Reader, header *model.FileTransferHeader) (io.Reader, error) {
+	return decompressReader(network.NewDataReader(limitDownload(conn, reader)), header.Compression)
+}
+
+// limits how fast the contents of a file are sent to the node at the other end of a connection
+func limitUpload(conn net.Conn) io.Writer {
+	return ratelimit.Writer(conn, ratelimit.UploadLimiters(connPeerID(conn))...)
+}
+
+// limits how fast the contents of a file are received from the node at the other end of a connection
+func limitDownload(conn net.Conn, r io.Reader) io.Reader {
+	return ratelimit.Reader(r, ratelimit.DownloadLimiters(connPeerID(conn))...)
+}
+
+// gets the ID of the node at the other end of a connection, which its rate limits are set by.
+// if it can't be identified, only the global limits apply.
+func connPeerID(conn net.Conn) string {
+	id, err := network.PeerID(conn)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// requests a file in a share from a peer, and takes a config scoped to the share (see config.ForShare).
+// returns the header the sender sent along with the file.
+//
+// if minVersion is given, the transfer is aborted unless the sender has that version of the file or a newer one.
+// the received file is only kept if its size and hash match what the sender announced in the header.
+// if an earlier transfer of the file was interrupted, only the rest of the file is requested.
+// beforeCommit, if given, is called right before the received file replaces the current copy.
+func RequestFile(sender model.Peer, conf config.Config, filePath string, minVersion model.VersionVector, beforeCommit BeforeCommit) (*model.FileTransferHeader, error) {
 	// connect to the sender node
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%v", senderIP, port))
+	conn, err := network.DialPeer(sender.IP, sender.ID, port, 0)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer conn.Close()
 
 	req := model.FileRequest{
-		Type: config.TYPE_FILE_REQUEST,
-		File: filePath,
+		Type:        config.TYPE_FILE_REQUEST,
+		Share:       conf.ShareID,
+		File:        filePath,
+		Compression: acceptedCompression(conf),
 	}
-	reqJson, err := json.Marshal(req)
-	if err != nil {
-		return false, err
+	if offset, hash := stagedProgress(conf.SharedDirectoryPath, filePath); offset > 0 {
+		fmt.Printf("resuming transfer of %s from byte %v\n", filePath, offset)
+		req.Offset = offset
+		req.Hash = hash
 	}
-
 	// send the file request info to the other node
-	_, err = conn.Write(reqJson)
-	if err != nil {
-		return false, err
+	if err := network.WriteMessage(conn, req); err != nil {
+		return nil, err
 	}
 
-	// TODO: receive the file over the existing connection
-	err = receiveFile(conn, filePath)
+	header, err := receiveFile(conn, conf.SharedDirectoryPath, filePath, minVersion, beforeCommit)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	fmt.Println("received file:", filePath)
-	return true, nil
+	fmt.Println("received file:", filePath, header.Version)
+	return header, nil
 }
 
-func receiveFile(conn net.Conn, filePath string) error {
+func receiveFile(conn net.Conn, mountDir string, filePath string, minVersion model.VersionVector, beforeCommit BeforeCommit) (*model.FileTransferHeader, error) {
 	if filePath == "" {
-		return errors.New("no filepath provided to receiveFile")
+		return nil, errors.New("no filepath provided to receiveFile")
 	}
-	// Create or open the file for writing
-	mountDir := config.GetMountDir(nil) // TODO pass in the config instead of loading it each time
-	fullPath := filepath.Join(mountDir, filePath)
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return errors.New("failed to create directory for new file: " + err.Error())
+	if _, err := util.SafeJoin(mountDir, filePath, config.STAGING_DIR); err != nil {
+		return nil, err
 	}
-	file, err := os.Create(fullPath)
+	reader := bufio.NewReader(conn)
+	header, err := readHeader(conn, reader)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := checkVersion(header, filePath, minVersion); err != nil {
+		return nil, err
+	}
+
+	// receive the file into the staging area first, so the current copy of the file stays intact until the new one is complete
+	file, err := openStaged(mountDir, filePath, header, false)
+	if err != nil {
+		return nil, err
 	}
 	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, header.Offset); err != nil {
+		return nil, err
+	}
 
-	// read an initial buffer to check for error messages
-	buf, err := network.ReadBuffer(conn, 1024)
+	// the rest of the stream is the file contents. if it's cut off, what was received is kept so the transfer can be resumed.
+	contents, err := contentsReader(conn, reader, header)
 	if err != nil {
-		os.Remove(fullPath)
-		return err
+		return nil, err
+	}
+	b, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(contents, header.Length))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if err := commitStaged(file, mountDir, filePath, header, header.Offset+b, hash, beforeCommit); err != nil {
+		return nil, err
 	}
-	b1, err := file.Write(buf)
+	fmt.Printf("wrote %v bytes to %s\n", b, filePath)
+	return header, nil
+}
+
+// makes sure the sender is sending the version of a file that we want
+func checkVersion(header *model.FileTransferHeader, filePath string, minVersion model.VersionVector) error {
+	if minVersion == nil {
+		return nil
+	}
+	if comparison := header.Version.Compare(minVersion); comparison == model.VERSION_OLDER || comparison == model.VERSION_CONCURRENT {
+		return fmt.Errorf("sender has version %s of %s; need %s or newer", header.Version, filePath, minVersion)
+	}
+	return nil
+}
+
+// opens the staged copy of a file for receiving the file described by the header.
+// anything staged past the header's offset is dropped; the sender either continues from where an earlier transfer left off, or starts over.
+// sparse is for files that are written out of order, which can't be resumed (see stagedProgress).
+func openStaged(mountDir string, filePath string, header *model.FileTransferHeader, sparse bool) (*os.File, error) {
+	partPath, _ := stagingPaths(mountDir, filePath)
+	if err := os.MkdirAll(filepath.Dir(partPath), os.ModePerm); err != nil {
+		return nil, errors.New("failed to create staging directory: " + err.Error())
+	}
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		os.Remove(fullPath)
+		return nil, err
+	}
+	if err := file.Truncate(header.Offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := saveStagedHeader(mountDir, filePath, header, sparse); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// verifies the staged copy of a file is the whole file described by the header, and if so moves it into place.
+// a staged copy that doesn't match the header is thrown away; one that is only incomplete is kept, so the transfer can be resumed.
+func commitStaged(file *os.File, mountDir string, filePath string, header *model.FileTransferHeader, received int64, hash hash.Hash, beforeCommit BeforeCommit) error {
+	if received < header.Size {
+		return fmt.Errorf("%w: received %v of %v bytes of %s", ErrVerificationFailed, received, header.Size, filePath)
+	}
+	if received > header.Size {
+		discardStaged(mountDir, filePath)
+		return fmt.Errorf("%w: received %v bytes of %s, but expected only %v", ErrVerificationFailed, received, filePath, header.Size)
+	}
+	if receivedHash := hex.EncodeToString(hash.Sum(nil)); receivedHash != header.Hash {
+		discardStaged(mountDir, filePath)
+		return fmt.Errorf("%w: hash of %s doesn't match (expected %s, got %s)", ErrVerificationFailed, filePath, header.Hash, receivedHash)
+	}
+	// make sure the contents are actually on disk before the file replaces the current copy
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
 		return err
 	}
-	// Read any remaining data in the stream
-	b2, err := io.Copy(file, conn)
+	partPath, _ := stagingPaths(mountDir, filePath)
+	if err := applyFileMetadata(partPath, header); err != nil {
+		fmt.Println("failed to apply file metadata:", err)
+	}
+	fullPath, err := util.SafeJoin(mountDir, filePath, config.STAGING_DIR)
 	if err != nil {
-		os.Remove(fullPath)
+		discardStaged(mountDir, filePath)
+		return err
+	}
+	if err := util.CheckCreatable(filePath); err != nil {
+		discardStaged(mountDir, filePath)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return errors.New("failed to create directory for new file: " + err.Error())
+	}
+	if beforeCommit != nil {
+		if err := beforeCommit(fullPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(partPath, fullPath); err != nil {
 		return err
 	}
-	fmt.Printf("wrote %v bytes to %s\n", int64(b1)+b2, fullPath)
+	discardStaged(mountDir, filePath)
+	return nil
+}
+
+// gives a received file the same permissions and modification time it has on the sender
+func applyFileMetadata(fullPath string, header *model.FileTransferHeader) error {
+	if header.Mode != 0 {
+		if err := os.Chmod(fullPath, header.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !header.ModTime.IsZero() {
+		return os.Chtimes(fullPath, header.ModTime, header.ModTime)
+	}
 	return nil
 }
+
+// reads the header the sender writes ahead of the file contents. if the sender replied with an error instead, it's returned as a *network.RemoteError.
+func readHeader(conn net.Conn, reader *bufio.Reader) (*model.FileTransferHeader, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		return nil, err
+	}
+	var header model.FileTransferHeader
+	if err := network.ReadMessage(reader, &header); err != nil {
+		var remoteErr *network.RemoteError
+		if errors.As(err, &remoteErr) {
+			return nil, err
+		}
+		return nil, errors.Join(errors.New("failed to read file header"), err)
+	}
+	// the header only needs to arrive promptly; the file itself may take a while
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
@@ -0,0 +1,103 @@
+package filetransfer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/webbben/p2p-file-share/internal/config"
+	"github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/network"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+func TestSendFileRejectsUnsafePaths(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testunsafe")
+	root := filepath.Join(testdir, "root")
+	outside := filepath.Join(testdir, "outside")
+	defer os.RemoveAll(testdir)
+
+	for _, dir := range []string{root, outside} {
+		if err := util.EnsureDir(dir); err != nil {
+			t.Error("failed to create test directory:", err)
+			return
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Error("failed to create test link:", err)
+		return
+	}
+
+	for _, name := range []string{
+		filepath.Join(outside, "secret.txt"),
+		filepath.Join("..", "outside", "secret.txt"),
+		filepath.Join("escape", "secret.txt"),
+	} {
+		client, server := net.Pipe()
+		go SendFile(server, config.Config{SharedDirectoryPath: root}, model.FileRequest{File: name}, nil, nil)
+
+		var header model.FileTransferHeader
+		var remoteErr *network.RemoteError
+		if err := network.ReadMessage(client, &header); !errors.As(err, &remoteErr) {
+			t.Errorf("%s: expected the request to be refused, got %v (header: %+v)", name, err, header)
+		}
+		client.Close()
+	}
+}
+
+func TestOpenFileToSendUsesIndexedHash(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testindexedhash")
+	defer os.RemoveAll(testdir)
+	if err := util.EnsureDir(testdir); err != nil {
+		t.Error("failed to create test directory:", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(testdir, "a.txt"), []byte("contents"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	info, err := os.Stat(filepath.Join(testdir, "a.txt"))
+	if err != nil {
+		t.Error("failed to stat test file:", err)
+		return
+	}
+
+	tests := []struct {
+		name     string
+		indexed  *model.FileTransferHeader
+		expected string
+	}{
+		{"not indexed", nil, hashChunk([]byte("contents"))},
+		{"unchanged", &model.FileTransferHeader{Size: info.Size(), ModTime: info.ModTime(), Hash: "indexed"}, "indexed"},
+		{"modified since", &model.FileTransferHeader{Size: info.Size(), ModTime: info.ModTime().Add(-time.Second), Hash: "indexed"}, hashChunk([]byte("contents"))},
+		{"resized since", &model.FileTransferHeader{Size: info.Size() + 1, ModTime: info.ModTime(), Hash: "indexed"}, hashChunk([]byte("contents"))},
+	}
+	for _, test := range tests {
+		file, _, hash, err := openFileToSend(nil, testdir, "a.txt", test.indexed)
+		if err != nil {
+			t.Errorf("%s: failed to open file: %s", test.name, err)
+			continue
+		}
+		file.Close()
+		if hash != test.expected {
+			t.Errorf("%s: expected hash %s, got %s", test.name, test.expected, hash)
+		}
+	}
+}
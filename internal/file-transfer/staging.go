@@ -0,0 +1,65 @@
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/webbben/p2p-file-share/internal/config"
+	"github.com/webbben/p2p-file-share/internal/model"
+)
+
+// gets where a file being received is staged, and where the header describing the file it will become is kept.
+// the names only depend on the file's path, so an interrupted transfer can be picked up again by a later one.
+func stagingPaths(mountDir string, filePath string) (string, string) {
+	sum := sha256.Sum256([]byte(filePath))
+	name := hex.EncodeToString(sum[:8]) + "-" + filepath.Base(filePath)
+	dir := filepath.Join(mountDir, config.STAGING_DIR)
+	return filepath.Join(dir, name+".part"), filepath.Join(dir, name+".header")
+}
+
+// the header of a file being received, as it's saved in the staging directory
+type stagingHeader struct {
+	model.FileTransferHeader
+	// whether the file is assembled out of order (e.g. from chunks), so what was received so far isn't a prefix of the file that can be resumed
+	Sparse bool `json:"sparse,omitempty"`
+}
+
+// finds how much of a file was already received by an earlier, interrupted transfer.
+// returns the number of bytes received and the hash of the file they belong to, or 0 if there's nothing to resume.
+func stagedProgress(mountDir string, filePath string) (int64, string) {
+	partPath, headerPath := stagingPaths(mountDir, filePath)
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return 0, ""
+	}
+	headerJson, err := os.ReadFile(headerPath)
+	if err != nil {
+		return 0, ""
+	}
+	var header stagingHeader
+	if err := json.Unmarshal(headerJson, &header); err != nil || header.Hash == "" || header.Sparse || info.Size() > header.Size {
+		return 0, ""
+	}
+	return info.Size(), header.Hash
+}
+
+// saves the header of a file being received, so the transfer can be resumed if it's interrupted.
+// sparse files can't be resumed, but the header is still saved so an earlier, resumable header isn't left behind.
+func saveStagedHeader(mountDir string, filePath string, header *model.FileTransferHeader, sparse bool) error {
+	_, headerPath := stagingPaths(mountDir, filePath)
+	headerJson, err := json.Marshal(stagingHeader{FileTransferHeader: *header, Sparse: sparse})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(headerPath, headerJson, 0644)
+}
+
+// throws away whatever was received of a file so far
+func discardStaged(mountDir string, filePath string) {
+	partPath, headerPath := stagingPaths(mountDir, filePath)
+	os.Remove(partPath)
+	os.Remove(headerPath)
+}
@@ -0,0 +1,107 @@
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+func TestStagedProgress(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	mountDir := filepath.Join(wd, "teststaging")
+	defer os.RemoveAll(mountDir)
+
+	header := &model.FileTransferHeader{File: "a.txt", Size: 10, Hash: "abc"}
+	for _, sparse := range []bool{false, true} {
+		file, err := openStaged(mountDir, "a.txt", header, sparse)
+		if err != nil {
+			t.Error("failed to open staged file:", err)
+			return
+		}
+		_, err = file.Write([]byte("12345"))
+		file.Close()
+		if err != nil {
+			t.Error("failed to write staged file:", err)
+			return
+		}
+
+		offset, hash := stagedProgress(mountDir, "a.txt")
+		if sparse && offset != 0 {
+			t.Errorf("a sparse staged file shouldn't be resumed; got offset %v", offset)
+		}
+		if !sparse && (offset != 5 || hash != header.Hash) {
+			t.Errorf("expected to resume at 5 bytes of %s; got %v bytes of %s", header.Hash, offset, hash)
+		}
+		discardStaged(mountDir, "a.txt")
+	}
+}
+
+func TestCommitStagedBeforeCommit(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	mountDir := filepath.Join(wd, "testcommit")
+	defer os.RemoveAll(mountDir)
+	if err := util.EnsureDir(mountDir); err != nil {
+		t.Error("failed to create test directory:", err)
+		return
+	}
+	fullPath := filepath.Join(mountDir, "a.txt")
+	if err := os.WriteFile(fullPath, []byte("local"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+
+	commit := func(beforeCommit BeforeCommit) error {
+		header := &model.FileTransferHeader{File: "a.txt", Size: 6, Hash: hashChunk([]byte("remote"))}
+		file, err := openStaged(mountDir, "a.txt", header, false)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.MultiWriter(file, hash).Write([]byte("remote")); err != nil {
+			return err
+		}
+		return commitStaged(file, mountDir, "a.txt", header, 6, hash, beforeCommit)
+	}
+
+	// a failing hook keeps the received file from replacing the current copy
+	if err := commit(func(string) error { return errors.New("not now") }); err == nil {
+		t.Error("expected the commit to fail")
+	}
+	if data, _ := os.ReadFile(fullPath); string(data) != "local" {
+		t.Errorf("current copy was replaced even though the hook failed: %q", data)
+	}
+
+	// the current copy is still in place when the hook runs, so it can be kept under a different name
+	keptPath := filepath.Join(mountDir, "a (conflict).txt")
+	err := commit(func(path string) error {
+		if data, err := os.ReadFile(path); err != nil || string(data) != "local" {
+			t.Errorf("expected the current copy at %s before committing; got %q (%v)", path, data, err)
+		}
+		return os.Rename(path, keptPath)
+	})
+	if err != nil {
+		t.Error("failed to commit staged file:", err)
+		return
+	}
+	if data, _ := os.ReadFile(fullPath); string(data) != "remote" {
+		t.Errorf("received file wasn't moved into place: %q", data)
+	}
+	if data, _ := os.ReadFile(keptPath); string(data) != "local" {
+		t.Errorf("current copy wasn't kept: %q", data)
+	}
+}
@@ -0,0 +1,151 @@
+// the keypair a node identifies itself with, and the TLS setup for connections between nodes
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Every node has its own keypair, generated the first time it runs, and a self-signed certificate for it.
+Connections between nodes use mutual TLS with these certificates. There's no certificate authority: instead, a node is identified by the
+fingerprint of its public key, which can't be claimed by any other node, unlike an IP address or a nickname.
+*/
+
+// a node's keypair and certificate
+type Identity struct {
+	Certificate tls.Certificate
+	Fingerprint string // fingerprint of the node's public key; the node's ID
+}
+
+// loads the identity stored at the given paths, generating a new one first if there isn't one yet.
+// the name is only put into newly generated certificates, to make them easier to recognise.
+func LoadOrCreate(certPath string, keyPath string, name string) (*Identity, error) {
+	if _, err := os.Stat(keyPath); errors.Is(err, os.ErrNotExist) {
+		if err := generate(certPath, keyPath, name); err != nil {
+			return nil, errors.Join(errors.New("failed to generate keypair"), err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to load keypair"), err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	return &Identity{
+		Certificate: cert,
+		Fingerprint: Fingerprint(leaf),
+	}, nil
+}
+
+// generates a new keypair and a self-signed certificate for it, and saves them as PEM files
+func generate(certPath string, keyPath string, name string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(100, 0, 0), // the key is the node's identity, so it doesn't expire
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
+		return err
+	}
+	// only this user may read the private key
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+}
+
+// gets the fingerprint of the public key in a certificate: the hex encoded SHA-256 of the key
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// gets the fingerprint of the node at the other end of a TLS connection, completing the handshake first if it hasn't happened yet
+func PeerFingerprint(conn *tls.Conn) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("peer didn't present a certificate")
+	}
+	return Fingerprint(certs[0]), nil
+}
+
+// the TLS config for accepting connections from other nodes. every node must present a certificate.
+func (id *Identity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:          []tls.Certificate{id.Certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifySelfSigned,
+		MinVersion:            tls.VersionTLS13,
+	}
+}
+
+// the TLS config for connecting to other nodes
+func (id *Identity) ClientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.Certificate},
+		// nodes' certificates aren't signed by any authority; instead, they are checked to be well-formed here,
+		// and nodes are identified by their fingerprints
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifySelfSigned,
+		MinVersion:            tls.VersionTLS13,
+	}
+}
+
+// checks that a node presented a single, valid, self-signed certificate.
+// TLS has already checked that the node holds the private key for it.
+func verifySelfSigned(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) != 1 {
+		return fmt.Errorf("expected a single certificate, got %v", len(rawCerts))
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return errors.Join(errors.New("certificate isn't self-signed"), err)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("certificate isn't valid at this time")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package identity
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	dir := filepath.Join(wd, "testidentity")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+
+	id, err := LoadOrCreate(certPath, keyPath, "laptop")
+	if err != nil {
+		t.Error("failed to create identity:", err)
+		return
+	}
+	if len(id.Fingerprint) != 64 {
+		t.Errorf("unexpected fingerprint: %q", id.Fingerprint)
+	}
+	// the identity is persistent
+	reloaded, err := LoadOrCreate(certPath, keyPath, "laptop")
+	if err != nil {
+		t.Error("failed to reload identity:", err)
+		return
+	}
+	if reloaded.Fingerprint != id.Fingerprint {
+		t.Errorf("fingerprint changed on reload: %s -> %s", id.Fingerprint, reloaded.Fingerprint)
+	}
+	other, err := LoadOrCreate(filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"), "laptop")
+	if err != nil {
+		t.Error("failed to create identity:", err)
+		return
+	}
+	if other.Fingerprint == id.Fingerprint {
+		t.Error("different keys have the same fingerprint")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	dir := filepath.Join(wd, "testtls")
+	defer os.RemoveAll(dir)
+	serverID, err := LoadOrCreate(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "server")
+	if err != nil {
+		t.Error("failed to create server identity:", err)
+		return
+	}
+	clientID, err := LoadOrCreate(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), "client")
+	if err != nil {
+		t.Error("failed to create client identity:", err)
+		return
+	}
+
+	// both ends learn the other's fingerprint
+	serverConn, clientConn := net.Pipe()
+	server := tls.Server(serverConn, serverID.ServerConfig())
+	client := tls.Client(clientConn, clientID.ClientConfig())
+	seenByServer := make(chan string)
+	go func() {
+		fingerprint, err := PeerFingerprint(server)
+		if err != nil {
+			t.Error("server handshake failed:", err)
+		}
+		seenByServer <- fingerprint
+	}()
+	seenByClient, err := PeerFingerprint(client)
+	if err != nil {
+		t.Error("client handshake failed:", err)
+		clientConn.Close()
+		serverConn.Close()
+		return
+	}
+	if seenByClient != serverID.Fingerprint {
+		t.Errorf("client saw fingerprint %s; expected %s", seenByClient, serverID.Fingerprint)
+	}
+	if fingerprint := <-seenByServer; fingerprint != clientID.Fingerprint {
+		t.Errorf("server saw fingerprint %s; expected %s", fingerprint, clientID.Fingerprint)
+	}
+	clientConn.Close()
+	serverConn.Close()
+
+	// a client without a certificate is turned away
+	serverConn, clientConn = net.Pipe()
+	server = tls.Server(serverConn, serverID.ServerConfig())
+	client = tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	go func() {
+		client.Handshake()
+		client.Read(make([]byte, 1)) // TLS 1.3 clients only learn of the rejection when reading
+		client.Close()
+	}()
+	if _, err := PeerFingerprint(server); err == nil {
+		t.Error("expected a client without a certificate to be rejected")
+	}
+	server.Close()
+}
@@ -2,7 +2,6 @@
 package messagebroker
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"time"
@@ -14,19 +13,23 @@ import (
 	"github.com/webbben/p2p-file-share/internal/state"
 )
 
-// broadcasts a message to all known peers
-func BroadcastMessage(msg interface{}) {
+// broadcasts a message to all known peers. if the config is scoped to a share, only to the peers the share is synced with,
+// and that aren't receive-only for the share (i.e. this node only receives changes from them).
+func BroadcastMessage(msg interface{}, config c.Config) {
 	// make sure there are peers to broadcast to
 	peers := state.GetPeers()
 	if len(peers) == 0 {
-		peers = peer.DiscoverPeers()
+		peers = peer.DiscoverPeers(config)
 		state.SetPeers(peers)
 	} else if state.PeerDataIsStale() {
-		peers = peer.DiscoverPeers()
+		peers = peer.DiscoverPeers(config)
 		state.SetPeers(peers)
 	}
 	for _, p := range peers {
-		if err := sendSimplexMessage(p, msg); err != nil {
+		if !config.IsShareMember(p.ID) || config.GetSyncMode(p.ID) == c.SYNC_RECEIVE_ONLY {
+			continue
+		}
+		if err := SendMessage(p, msg); err != nil {
 			fmt.Println("Failed to send message to peer;", err, "; peer info:", p)
 			continue
 		}
@@ -34,52 +37,42 @@ func BroadcastMessage(msg interface{}) {
 }
 
 // sends a message to a peer without expecting a response
-func sendSimplexMessage(p m.Peer, msg interface{}) error {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%v", p.IP, c.PORT), time.Millisecond*time.Duration(c.MESSAGE_TIMEOUT_MS))
+func SendMessage(p m.Peer, msg interface{}) error {
+	conn, err := dialPeer(p)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	jsonData, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	_, err = conn.Write(jsonData)
-	return err
+	return network.WriteMessage(conn, msg)
 }
 
-// gets the file information from a node
-func scanFiles(p m.Peer) ([]m.FileInfo, error) {
-	buf, err := sendDuplexMessage(p, m.MiscMessage{Type: c.TYPE_SCAN_FILES})
-	if err != nil {
-		return nil, err
-	}
+// gets the file information of one of a node's shares
+func ScanFiles(p m.Peer, shareID string) ([]m.FileInfo, error) {
 	// we expect a summary of the file info in response
 	var fileSummary m.NodeFileSummary
-	if err = json.Unmarshal(buf, &fileSummary); err != nil {
+	if err := sendDuplexMessage(p, m.FileSummaryRequest{Type: c.TYPE_SCAN_FILES, Share: shareID}, &fileSummary); err != nil {
 		return nil, err
 	}
 	return fileSummary.Files, nil
 }
 
-// sends a message that expects a response from the peer
-func sendDuplexMessage(p m.Peer, msg interface{}) ([]byte, error) {
-	conn, err := net.DialTimeout("tcp", network.FormatSocketAddr(p.IP, c.PORT), time.Millisecond*time.Duration(c.MESSAGE_TIMEOUT_MS))
+// sends a message that expects a response from the peer, and decodes the response into resp
+func sendDuplexMessage(p m.Peer, msg interface{}, resp interface{}) error {
+	conn, err := dialPeer(p)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer conn.Close()
-	bytes, err := json.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write(bytes)
-	if err != nil {
-		return nil, err
+	if err := network.WriteMessage(conn, msg); err != nil {
+		return err
 	}
-	buf, err := network.ReadBuffer(conn, 1024)
-	if err != nil {
-		return nil, err
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(c.MESSAGE_TIMEOUT_MS_LONG))); err != nil {
+		return err
 	}
-	return buf, nil
+	return network.ReadMessage(conn, resp)
+}
+
+// connects to a peer, making sure it's the same node we paired with
+func dialPeer(p m.Peer) (net.Conn, error) {
+	return network.DialPeer(p.IP, p.ID, c.PORT, time.Millisecond*time.Duration(c.MESSAGE_TIMEOUT_MS))
 }
@@ -1,52 +1,152 @@
 package model
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"time"
+)
 
 /*
-All messages should include a "type" property so the TCP servers can detect the purpose of the message
+All messages should include a "type" property so the TCP servers can detect the purpose of the message.
+Messages are sent as message frames (see network.WriteMessage).
 */
 
 type Handshake struct {
-	Type     string `json:"type"`
-	Data     string `json:"data"`     // misc data to send in the handshake, in case we want to verify authenticity (TODO)
-	Nickname string `json:"nickname"` // nickname of the node sending this handshake
+	Type            string `json:"type"`
+	ProtocolVersion int    `json:"protocol_version"` // version of the protocol the node sending this handshake speaks
+	Data            string `json:"data"`             // misc data to send in the handshake
+	Nickname        string `json:"nickname"`         // nickname of the node sending this handshake
+
+	// for proving that both nodes know the cluster secret: a random challenge for the other node, and the answer to the other node's challenge
+	Nonce string `json:"nonce,omitempty"`
+	Proof string `json:"proof,omitempty"`
 }
 
 // a request for a file to be sent from one node to another
 type FileRequest struct {
-	Type string `json:"type"`
-	File string `json:"file"` // the path of the file (relative to the mount directory)
+	Type  string `json:"type"`
+	Share string `json:"share"` // ID of the share the file is in
+	File  string `json:"file"`  // the path of the file (relative to the share's directory)
+
+	// for resuming a transfer or getting part of a file: the range of bytes to send. a length of 0 means up to the end of the file.
+	// if a hash is given, the range is only sent if the file still has that SHA-256 hash; otherwise the whole file is sent.
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+
+	Compression []string `json:"compression,omitempty"` // compression formats the requester accepts; the sender picks one of them, or none
+}
+
+// a request for the changes to a file, which the receiver already has an older copy of.
+// the sender replies with instructions for turning the receiver's copy into the sender's (see filetransfer for details).
+type DeltaRequest struct {
+	Type       string           `json:"type"`
+	Share      string           `json:"share"`      // ID of the share the file is in
+	File       string           `json:"file"`       // the path of the file (relative to the share's directory)
+	BlockSize  int              `json:"block_size"` // size of the blocks the receiver's copy was split into
+	Signatures []BlockSignature `json:"signatures"` // signatures of each block of the receiver's copy, in order
+
+	Compression []string `json:"compression,omitempty"` // compression formats the requester accepts; the sender picks one of them, or none
+}
+
+// identifies a block of a file, so the sender of a delta can tell whether the receiver already has it
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`   // rolling checksum; cheap to compute at every offset of a file
+	Strong string `json:"strong"` // hash of the block, for confirming matches of the rolling checksum
 }
 
 type NotifyFileChange struct {
-	Type   string `json:"type"`
-	File   string `json:"file"`   // the path of the file (relative to the mount directory)
-	IsDir  bool   `json:"is_dir"` // whether or not this file is a directory
-	Change string `json:"change"` // the type of change that occurred, e.g. modified, deleted, etc.
+	Type     string        `json:"type"`
+	Share    string        `json:"share"`   // ID of the share the file is in
+	File     string        `json:"file"`    // the path of the file (relative to the share's directory)
+	IsDir    bool          `json:"is_dir"`  // whether or not this file is a directory
+	Change   string        `json:"change"`  // the type of change that occurred, e.g. modified, deleted, etc.
+	Version  VersionVector `json:"version"` // the version of the file after this change
+	Checksum string        `json:"cksm"`    // SHA-256 of the file contents after this change; empty for deletions and directories
+	Mode     os.FileMode   `json:"mode"`    // file mode (permissions) after this change
+	Size     int64         `json:"size"`    // size of the file after this change
+	Node     string        `json:"node"`    // ID of the node that made the change
+	Time     time.Time     `json:"time"`    // when the change was made
+
+	// for symbolic links synced as links, the path the link points to (relative to the link). links are created from the notification, without a transfer.
+	LinkTarget string `json:"link_target,omitempty"`
+
+	// for renames, the previous path of the file and the version of its deletion from that path
+	OldFile    string        `json:"old_file,omitempty"`
+	OldVersion VersionVector `json:"old_version,omitempty"`
 }
 
 func (n NotifyFileChange) String() string {
 	return fmt.Sprintf("%s (%s)", n.File, n.Change)
 }
 
+// sent ahead of the file contents in response to a FileRequest, describing the file being sent
+type FileTransferHeader struct {
+	File    string        `json:"file"`    // the path of the file (relative to the share's directory)
+	Version VersionVector `json:"version"` // the version of the file that is being sent
+	Mode    os.FileMode   `json:"mode"`    // file mode (permissions), applied to the received file
+	ModTime time.Time     `json:"mtime"`   // modification time, applied to the received file
+	Size    int64         `json:"size"`    // size of the whole file
+	Hash    string        `json:"hash"`    // SHA-256 of the whole file, so the receiver can verify it got the whole file intact
+	Offset  int64         `json:"offset"`  // where in the file the contents that follow the header start
+	Length  int64         `json:"length"`  // number of bytes of file contents that follow the header (before compression)
+
+	Compression string `json:"compression,omitempty"` // the compression format the contents that follow the header are in, if any
+
+	Chunks []Chunk `json:"chunks,omitempty"` // in reply to a chunk list request, the chunks the file is made of; no file contents follow the header
+}
+
+// a content-defined chunk of a file
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"` // SHA-256 of the chunk
+}
+
 // message for where only the type is needed; no special content needs to be passed
 type MiscMessage struct {
 	Type string `json:"type"`
 }
 
-// a summary of the files on a node
+// a request for the summary of the files in one of a node's shares
+type FileSummaryRequest struct {
+	Type  string `json:"type"`
+	Share string `json:"share"` // ID of the share
+}
+
+// a summary of the files in one of a node's shares
 type NodeFileSummary struct {
 	Type  string     `json:"type"`
+	Share string     `json:"share"` // ID of the share
 	Files []FileInfo `json:"files"`
 }
 
 // information about a file
 type FileInfo struct {
-	Name     string `json:"name"`
-	Checksum string `json:"cksm"`
+	Name     string        `json:"name"`
+	Checksum string        `json:"cksm"` // SHA-256 of the file contents
+	Mode     os.FileMode   `json:"mode"`
+	Size     int64         `json:"size"`
+	IsDir    bool          `json:"is_dir"`
+	Deleted  bool          `json:"deleted"` // whether the file has been deleted; its version is kept so other nodes know to delete it too
+	Version  VersionVector `json:"version"`
+
+	DeletedBy string    `json:"deleted_by,omitempty"` // ID of the node that deleted the file
+	DeletedAt time.Time `json:"deleted_at,omitempty"`
+
+	LinkTarget string `json:"link_target,omitempty"` // for symbolic links synced as links, the path the link points to
 }
 
 type Peer struct {
+	ID       string `json:"id"` // fingerprint of the peer's public key, which identifies it no matter which IP it's at
 	IP       string `json:"ip"`
 	Nickname string `json:"nickname"`
 }
+
+// the ID of the peer, or its IP if its ID isn't known
+func (p Peer) Key() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.IP
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// a version vector tracks how many changes each node has made to a file.
+// maps the ID of a node to the number of changes it has made.
+type VersionVector map[string]uint64
+
+// the possible results of comparing two version vectors
+const (
+	VERSION_EQUAL      int = iota // both vectors describe the same version
+	VERSION_NEWER                 // the vector dominates the other one
+	VERSION_OLDER                 // the vector is dominated by the other one
+	VERSION_CONCURRENT            // neither vector dominates; the changes happened concurrently
+)
+
+// compares this version vector to another one.
+//
+// returns VERSION_NEWER if v contains every change in other plus at least one more,
+// VERSION_OLDER if the opposite is true, VERSION_EQUAL if they're the same and VERSION_CONCURRENT otherwise.
+func (v VersionVector) Compare(other VersionVector) int {
+	newer, older := false, false
+	for node, count := range v {
+		if count > other[node] {
+			newer = true
+		} else if count < other[node] {
+			older = true
+		}
+	}
+	for node, count := range other {
+		if _, exists := v[node]; !exists && count > 0 {
+			older = true
+		}
+	}
+	switch {
+	case newer && older:
+		return VERSION_CONCURRENT
+	case newer:
+		return VERSION_NEWER
+	case older:
+		return VERSION_OLDER
+	}
+	return VERSION_EQUAL
+}
+
+// returns a copy of the vector with the given node's counter incremented
+func (v VersionVector) Increment(node string) VersionVector {
+	out := v.Copy()
+	out[node]++
+	return out
+}
+
+// returns a new vector containing the highest counter of each node in both vectors
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	out := v.Copy()
+	for node, count := range other {
+		if count > out[node] {
+			out[node] = count
+		}
+	}
+	return out
+}
+
+func (v VersionVector) Copy() VersionVector {
+	out := make(VersionVector, len(v))
+	for node, count := range v {
+		out[node] = count
+	}
+	return out
+}
+
+// whether the vector has no recorded changes at all
+func (v VersionVector) IsEmpty() bool {
+	for _, count := range v {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v VersionVector) String() string {
+	nodes := make([]string, 0, len(v))
+	for node := range v {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, fmt.Sprintf("%s:%v", node, v[node]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,45 @@
+package model
+
+import "testing"
+
+func TestVersionVectorCompare(t *testing.T) {
+	testCases := []struct {
+		Name string
+		A    VersionVector
+		B    VersionVector
+		Exp  int
+	}{
+		{Name: "both empty", A: VersionVector{}, B: nil, Exp: VERSION_EQUAL},
+		{Name: "same counters", A: VersionVector{"a": 2, "b": 1}, B: VersionVector{"a": 2, "b": 1}, Exp: VERSION_EQUAL},
+		{Name: "zero counter is same as missing", A: VersionVector{"a": 1, "b": 0}, B: VersionVector{"a": 1}, Exp: VERSION_EQUAL},
+		{Name: "newer than empty", A: VersionVector{"a": 1}, B: nil, Exp: VERSION_NEWER},
+		{Name: "newer counter", A: VersionVector{"a": 2, "b": 1}, B: VersionVector{"a": 1, "b": 1}, Exp: VERSION_NEWER},
+		{Name: "older missing node", A: VersionVector{"a": 1}, B: VersionVector{"a": 1, "b": 1}, Exp: VERSION_OLDER},
+		{Name: "concurrent", A: VersionVector{"a": 2, "b": 1}, B: VersionVector{"a": 1, "b": 2}, Exp: VERSION_CONCURRENT},
+		{Name: "concurrent disjoint", A: VersionVector{"a": 1}, B: VersionVector{"b": 1}, Exp: VERSION_CONCURRENT},
+	}
+	for _, testCase := range testCases {
+		if got := testCase.A.Compare(testCase.B); got != testCase.Exp {
+			t.Errorf("%s: exp %v, got %v", testCase.Name, testCase.Exp, got)
+		}
+	}
+}
+
+func TestVersionVectorMerge(t *testing.T) {
+	a := VersionVector{"a": 2, "b": 1}
+	b := VersionVector{"a": 1, "b": 3, "c": 1}
+	merged := a.Merge(b)
+	if merged.Compare(a) != VERSION_NEWER || merged.Compare(b) != VERSION_NEWER {
+		t.Errorf("merged vector should dominate both inputs: %s", merged)
+	}
+	if merged.String() != "{a:2,b:3,c:1}" {
+		t.Errorf("unexpected merge result: %s", merged)
+	}
+	// inputs should be left untouched
+	if a.String() != "{a:2,b:1}" {
+		t.Errorf("merge modified its input: %s", a)
+	}
+	if a.Increment("a")["a"] != 3 || a["a"] != 2 {
+		t.Error("increment should return a new vector with the counter increased")
+	}
+}
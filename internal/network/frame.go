@@ -0,0 +1,201 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+Everything nodes send each other is split into frames. each frame starts with a one byte type and a 4 byte (big endian) payload length,
+followed by the payload itself:
+
+  - message: a JSON message, such as a request, a handshake or the header of a file transfer
+  - data: a piece of a stream of bytes, such as the contents of a file
+  - end: the end of a stream of data frames; the payload is empty
+  - error: the sender couldn't do what was asked; the payload is a description of the problem
+
+since the receiver always knows how much to read, messages can be any size (up to MAX_FRAME_SIZE), and errors can't be mistaken for data.
+the payload is read into memory as it arrives, rather than all at once up front, so a peer can't make us allocate memory just by announcing a big frame.
+*/
+
+// frame types
+const (
+	FRAME_MESSAGE byte = 'M'
+	FRAME_DATA    byte = 'D'
+	FRAME_END     byte = 'E'
+	FRAME_ERROR   byte = 'X'
+)
+
+const (
+	MAX_FRAME_SIZE         = 64 * 1024 * 1024 // frames bigger than this are rejected, rather than allocating however much a peer asks for
+	MAX_CONTROL_FRAME_SIZE = 64 * 1024        // limit for handshakes, and anything else sent before a node has proven it's paired
+	dataFrameSize          = 32 * 1024        // streams of data are sent in frames of at most this size
+	frameHeaderLen         = 5
+)
+
+// the node at the other end of a connection sent an error frame
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// a frame of a different type than expected was received, e.g. data where a message should be
+var ErrUnexpectedFrame = errors.New("unexpected frame")
+
+// writes a single frame
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	if len(payload) > MAX_FRAME_SIZE {
+		return fmt.Errorf("frame too large: %v bytes", len(payload))
+	}
+	frame := make([]byte, frameHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:frameHeaderLen], uint32(len(payload)))
+	copy(frame[frameHeaderLen:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// reads a single frame, returning its type and payload
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	return ReadFrameLimit(r, MAX_FRAME_SIZE)
+}
+
+// reads a single frame like ReadFrame, but rejects frames with a payload bigger than limit
+func ReadFrameLimit(r io.Reader, limit int) (byte, []byte, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if int64(length) > int64(limit) {
+		return 0, nil, fmt.Errorf("frame too large: %v bytes", length)
+	}
+	// the buffer grows as the payload comes in, so announcing a big frame without sending it doesn't cost us anything
+	payload, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil || len(payload) < int(length) {
+		return 0, nil, errors.Join(errors.New("frame cut off"), io.ErrUnexpectedEOF)
+	}
+	return header[0], payload, nil
+}
+
+// encodes a message as JSON and writes it as a message frame
+func WriteMessage(w io.Writer, msg interface{}) error {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, FRAME_MESSAGE, jsonData)
+}
+
+// tells the node at the other end of a connection that its request failed
+func WriteError(w io.Writer, msg string) error {
+	return WriteFrame(w, FRAME_ERROR, []byte(msg))
+}
+
+// reads a message frame and decodes its JSON into msg.
+// if the other node sent an error frame instead, it's returned as a *RemoteError.
+func ReadMessage(r io.Reader, msg interface{}) error {
+	return ReadMessageLimit(r, msg, MAX_FRAME_SIZE)
+}
+
+// reads a message like ReadMessage, but rejects messages bigger than limit, e.g. MAX_CONTROL_FRAME_SIZE for handshakes
+func ReadMessageLimit(r io.Reader, msg interface{}, limit int) error {
+	frameType, payload, err := ReadFrameLimit(r, limit)
+	if err != nil {
+		return err
+	}
+	switch frameType {
+	case FRAME_MESSAGE:
+		return json.Unmarshal(payload, msg)
+	case FRAME_ERROR:
+		return &RemoteError{Message: string(payload)}
+	}
+	return fmt.Errorf("%w: expected a message, got frame type %q", ErrUnexpectedFrame, frameType)
+}
+
+type dataWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// wraps a writer so everything written to it is sent as data frames. closing it flushes what's left and sends an end frame;
+// it doesn't close the underlying writer.
+func NewDataWriter(w io.Writer) io.WriteCloser {
+	return &dataWriter{w: w, buf: make([]byte, 0, dataFrameSize)}
+}
+
+func (d *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(d.buf[len(d.buf):cap(d.buf)], p)
+		d.buf = d.buf[:len(d.buf)+n]
+		p = p[n:]
+		written += n
+		if len(d.buf) == cap(d.buf) {
+			if err := d.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (d *dataWriter) flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	err := WriteFrame(d.w, FRAME_DATA, d.buf)
+	d.buf = d.buf[:0]
+	return err
+}
+
+func (d *dataWriter) Close() error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	return WriteFrame(d.w, FRAME_END, nil)
+}
+
+type dataReader struct {
+	r       io.Reader
+	pending []byte
+	err     error
+}
+
+// wraps a reader of data frames, so the data they carry can be read as one stream. reads return io.EOF after the end frame.
+// if the stream is cut off before the end frame, reads fail with io.ErrUnexpectedEOF; if the sender sends an error frame, with a *RemoteError.
+func NewDataReader(r io.Reader) io.Reader {
+	return &dataReader{r: r}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		frameType, payload, err := ReadFrame(d.r)
+		switch {
+		case err == io.EOF:
+			d.err = io.ErrUnexpectedEOF
+		case err != nil:
+			d.err = err
+		case frameType == FRAME_DATA:
+			d.pending = payload
+		case frameType == FRAME_END:
+			d.err = io.EOF
+		case frameType == FRAME_ERROR:
+			d.err = &RemoteError{Message: string(payload)}
+		default:
+			d.err = fmt.Errorf("%w: expected data, got frame type %q", ErrUnexpectedFrame, frameType)
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageFrames(t *testing.T) {
+	type message struct {
+		Type string `json:"type"`
+		File string `json:"file"`
+	}
+	// long enough that it would never have fit in a single read
+	sent := message{Type: "file_request", File: strings.Repeat("very/long/path/", 1000) + "file.txt"}
+
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, sent); err != nil {
+		t.Fatal("failed to write message:", err)
+	}
+	if err := WriteError(&buf, "failed to open file: file.txt"); err != nil {
+		t.Fatal("failed to write error:", err)
+	}
+
+	var received message
+	if err := ReadMessage(&buf, &received); err != nil {
+		t.Fatal("failed to read message:", err)
+	}
+	if received != sent {
+		t.Errorf("message changed in transit: got %+v", received)
+	}
+	var remoteErr *RemoteError
+	if err := ReadMessage(&buf, &received); !errors.As(err, &remoteErr) || remoteErr.Message != "failed to open file: file.txt" {
+		t.Errorf("expected the remote error, got %v", err)
+	}
+}
+
+func TestDataFrames(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), dataFrameSize/4) // spans several frames
+
+	var buf bytes.Buffer
+	w := NewDataWriter(&buf)
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal("failed to write data:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("failed to close data writer:", err)
+	}
+	stream := buf.Bytes()
+
+	received, err := io.ReadAll(NewDataReader(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal("failed to read data:", err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Errorf("data changed in transit: got %v bytes, expected %v", len(received), len(contents))
+	}
+
+	// a stream that is cut off must not look like a complete one
+	_, err = io.ReadAll(NewDataReader(bytes.NewReader(stream[:len(stream)-frameHeaderLen])))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a cut off stream to fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// the sender can give up partway through
+	buf.Reset()
+	WriteFrame(&buf, FRAME_DATA, []byte("some data"))
+	WriteError(&buf, "file changed while sending")
+	var remoteErr *RemoteError
+	if _, err := io.ReadAll(NewDataReader(&buf)); !errors.As(err, &remoteErr) {
+		t.Errorf("expected the remote error, got %v", err)
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	// a peer can't make us allocate however much it wants
+	huge := []byte{FRAME_MESSAGE, 0xff, 0xff, 0xff, 0xff}
+	if _, _, err := ReadFrame(bytes.NewReader(huge)); err == nil {
+		t.Error("expected a frame larger than MAX_FRAME_SIZE to be rejected")
+	}
+	// nor much at all before it has paired
+	var control bytes.Buffer
+	WriteFrame(&control, FRAME_MESSAGE, make([]byte, MAX_CONTROL_FRAME_SIZE+1))
+	if _, _, err := ReadFrameLimit(&control, MAX_CONTROL_FRAME_SIZE); err == nil {
+		t.Error("expected a frame larger than the limit to be rejected")
+	}
+	// announcing a big frame without sending it just means the frame was cut off
+	announced := []byte{FRAME_MESSAGE, 0x03, 0xff, 0xff, 0xff, '{', '}'}
+	if _, _, err := ReadFrame(bytes.NewReader(announced)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a cut off frame to fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, FRAME_DATA, []byte("not a message"))
+	var msg map[string]interface{}
+	if err := ReadMessage(&buf, &msg); !errors.Is(err, ErrUnexpectedFrame) {
+		t.Errorf("expected ErrUnexpectedFrame, got %v", err)
+	}
+}
@@ -2,11 +2,9 @@
 package network
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strings"
-	"time"
 )
 
 // finds the IP address for this machine
@@ -49,25 +47,6 @@ func GetRemoteIP(conn net.Conn) string {
 	return strings.Split(conn.RemoteAddr().String(), ":")[0]
 }
 
-// reads a buffer from a connection, detecting protocol-specified error messages at the same time
-func ReadBuffer(conn net.Conn, bufferSize int) ([]byte, error) {
-	buf := make([]byte, 1024)
-	err := conn.SetDeadline(time.Now().Add(time.Second * 5))
-	if err != nil {
-		return []byte{}, err
-	}
-	n, err := conn.Read(buf)
-	if err != nil {
-		return []byte{}, errors.Join(errors.New("failed to read buffer"), err)
-	}
-	response := string(buf[:n])
-	if strings.HasPrefix(response, "ERROR:") {
-		errorMsg := strings.TrimPrefix(response, "ERROR:")
-		return []byte{}, errors.New(errorMsg)
-	}
-	return buf[:n], nil
-}
-
 // forms the socket address from an ip and port; for ease of use
 func FormatSocketAddr(ip string, port int) string {
 	return fmt.Sprintf("%s:%v", ip, port)
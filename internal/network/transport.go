@@ -0,0 +1,132 @@
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/webbben/p2p-file-share/internal/identity"
+)
+
+var (
+	nodeIdentity      *identity.Identity
+	nodeIdentityMutex sync.RWMutex
+)
+
+// sets the identity this node uses for all connections to and from other nodes. must be called before Dial or Listen.
+func UseIdentity(id *identity.Identity) {
+	nodeIdentityMutex.Lock()
+	defer nodeIdentityMutex.Unlock()
+	nodeIdentity = id
+}
+
+func getIdentity() (*identity.Identity, error) {
+	nodeIdentityMutex.RLock()
+	defer nodeIdentityMutex.RUnlock()
+	if nodeIdentity == nil {
+		return nil, errors.New("no node identity set")
+	}
+	return nodeIdentity, nil
+}
+
+// gets the ID (key fingerprint) of this node
+func LocalID() (string, error) {
+	id, err := getIdentity()
+	if err != nil {
+		return "", err
+	}
+	return id.Fingerprint, nil
+}
+
+// connects to another node over mutual TLS. a timeout of 0 means no timeout.
+func Dial(ip string, port int, timeout time.Duration) (net.Conn, error) {
+	id, err := getIdentity()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", FormatSocketAddr(ip, port), id.ClientConfig())
+}
+
+// connects to a peer, like Dial, and makes sure the node that answers is the peer with the given ID (see VerifyPeer).
+// peers are always dialed this way, so that a node that takes over a peer's IP address can't be sent or send anything in its place.
+func DialPeer(ip string, id string, port int, timeout time.Duration) (net.Conn, error) {
+	if id == "" {
+		return nil, fmt.Errorf("can't connect to peer at %s: its ID isn't known", ip)
+	}
+	conn, err := Dial(ip, port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyPeer(conn, id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listens for connections from other nodes over mutual TLS
+func Listen(port int) (net.Listener, error) {
+	id, err := getIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", fmt.Sprintf(":%v", port), id.ServerConfig())
+}
+
+// a connection that times out once no data has moved through it for a while.
+// every read and write pushes its deadline back, so long transfers can take as long as they need, but a peer that stalls doesn't hold on to the connection.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// wraps a connection so that reads and writes fail once the connection has been idle for longer than timeout
+func WithIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	return &idleTimeoutConn{Conn: conn, timeout: timeout}
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// gets the ID (key fingerprint) of the node at the other end of a connection
+func PeerID(conn net.Conn) (string, error) {
+	if idleConn, ok := conn.(*idleTimeoutConn); ok {
+		conn = idleConn.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errors.New("connection isn't encrypted")
+	}
+	return identity.PeerFingerprint(tlsConn)
+}
+
+// makes sure the node at the other end of a connection is the one we meant to connect to, and not another node that has taken over its IP address.
+// an empty ID means we don't know which node to expect yet.
+func VerifyPeer(conn net.Conn, expectedID string) error {
+	if expectedID == "" {
+		return nil
+	}
+	id, err := PeerID(conn)
+	if err != nil {
+		return err
+	}
+	if id != expectedID {
+		return fmt.Errorf("peer at %s has ID %s; expected %s", GetRemoteIP(conn), id, expectedID)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := WithIdleTimeout(server, 50*time.Millisecond)
+	defer conn.Close()
+
+	// data trickling in keeps the connection open for longer than the timeout
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(30 * time.Millisecond)
+			client.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Errorf("read %v failed while data was still coming in: %s", i, err)
+			return
+		}
+	}
+
+	// but once it stops, so does the connection
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("expected an idle connection to time out; got", err)
+	}
+	if _, err := conn.Write([]byte("nobody is reading")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("expected a write nobody reads to time out; got", err)
+	}
+}
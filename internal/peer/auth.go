@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+/*
+Pairing: nodes only pair up if they were set up with the same cluster secret (see config.NewClusterSecret).
+
+The secret itself is never sent. Instead, both nodes send a random nonce, and each proves it knows the secret by sending an HMAC of both nonces
+and both nodes' IDs, keyed with the secret. Fresh nonces mean a proof can't be replayed, and the IDs (key fingerprints from the TLS connection)
+mean a proof can't be relayed to a different node.
+
+The node that starts the handshake proves itself first. The responder only sends its proof after checking the initiator's, so a node that
+connects without knowing the secret doesn't get an HMAC it could use to try guessing the secret offline.
+*/
+
+const nonceLength = 32
+
+// roles in a handshake, so the proof of one side can't be reflected back as the proof of the other
+const (
+	roleInitiator = "initiator"
+	roleResponder = "responder"
+)
+
+var errBadProof = errors.New("peer doesn't know the cluster secret")
+
+func newNonce() (string, error) {
+	nonce := make([]byte, nonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// computes the proof that the node with the given role knows the cluster secret
+func handshakeProof(secret string, role string, initiatorNonce string, responderNonce string, initiatorID string, responderID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{role, initiatorNonce, responderNonce, initiatorID, responderID} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0}) // separator, so fields can't run into each other
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// computes a tag that identifies the cluster secret without giving it away, to record which secret a peer proved it knows
+func secretTag(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("known peer"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checks the proof a peer sent, in constant time
+func verifyProof(proof string, expected string) error {
+	if !hmac.Equal([]byte(proof), []byte(expected)) {
+		return errBadProof
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package peer
+
+import "testing"
+
+func TestHandshakeProof(t *testing.T) {
+	initiatorNonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderNonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initiatorNonce == responderNonce {
+		t.Fatal("nonces aren't random")
+	}
+
+	proof := handshakeProof("secret", roleResponder, initiatorNonce, responderNonce, "node-a", "node-b")
+	if err := verifyProof(proof, handshakeProof("secret", roleResponder, initiatorNonce, responderNonce, "node-a", "node-b")); err != nil {
+		t.Error("valid proof was rejected:", err)
+	}
+
+	testCases := map[string]string{
+		"wrong secret":          handshakeProof("other secret", roleResponder, initiatorNonce, responderNonce, "node-a", "node-b"),
+		"reflected proof":       handshakeProof("secret", roleInitiator, initiatorNonce, responderNonce, "node-a", "node-b"),
+		"replayed proof":        handshakeProof("secret", roleResponder, responderNonce, initiatorNonce, "node-a", "node-b"),
+		"relayed to a new node": handshakeProof("secret", roleResponder, initiatorNonce, responderNonce, "node-a", "node-c"),
+		"no proof":              "",
+	}
+	for name, forged := range testCases {
+		if err := verifyProof(forged, proof); err == nil {
+			t.Errorf("%s: forged proof was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// a peer this node has seen before. peers are pinned to their IDs (key fingerprints) the first time they're seen,
+// so another node can't pass itself off as a known peer by taking its nickname.
+//
+// a known peer is only paired with this node if it proved it knows the current cluster secret. peers that were pinned before pairing needed that proof,
+// or that proved a secret that has since been changed, have to pass the handshake again before they're trusted.
+type KnownPeer struct {
+	Nickname   string    `json:"nickname"`
+	IP         string    `json:"ip"` // the IP the peer was last seen at
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	PairedWith string    `json:"paired_with,omitempty"` // tag of the cluster secret the peer proved it knows (see secretTag)
+}
+
+// whether the peer proved it knows the given cluster secret
+func (known KnownPeer) pairedWith(secret string) bool {
+	return secret != "" && known.PairedWith == secretTag(secret)
+}
+
+var (
+	knownPeers      map[string]KnownPeer // loaded from the known peers file on first use
+	knownPeersMutex sync.Mutex
+)
+
+func knownPeersFilePath() string {
+	return c.DataFilePath("known_peers.json")
+}
+
+// gets the peers this node has paired with before, by ID
+func GetKnownPeers() map[string]KnownPeer {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	loadKnownPeers()
+	peers := make(map[string]KnownPeer, len(knownPeers))
+	for id, known := range knownPeers {
+		peers[id] = known
+	}
+	return peers
+}
+
+// whether this node has paired with the node with the given ID, i.e. the node has proven it knows the cluster secret
+func IsPaired(id string, secret string) bool {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	loadKnownPeers()
+	known, exists := knownPeers[id]
+	return exists && known.pairedWith(secret)
+}
+
+// loads the known peers, if they haven't been loaded yet. the caller must hold knownPeersMutex.
+func loadKnownPeers() {
+	if knownPeers != nil {
+		return
+	}
+	knownPeers = map[string]KnownPeer{}
+	jsonData, err := os.ReadFile(knownPeersFilePath())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("failed to read known peers:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(jsonData, &knownPeers); err != nil {
+		fmt.Println("error unmarshalling known peers:", err)
+	}
+}
+
+// checks a peer that just proved it knows the cluster secret against the known peers, and records it as paired.
+// fails if the peer's nickname is pinned to a different ID, which means another node is claiming to be that peer
+// (or the peer was reinstalled, and needs to be removed from the known peers file to be trusted again).
+// only peers that are paired with the current secret hold on to their nicknames; any other peer with the same nickname is forgotten.
+func pinPeer(p m.Peer, secret string) error {
+	if p.ID == "" {
+		return errors.New("peer has no ID")
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	loadKnownPeers()
+	if p.Nickname != "" {
+		for id, known := range knownPeers {
+			if id != p.ID && known.Nickname == p.Nickname && known.pairedWith(secret) {
+				return fmt.Errorf("peer %s at %s has ID %s, but that nickname is pinned to ID %s; if the peer was reinstalled, remove it from %s",
+					p.Nickname, p.IP, p.ID, id, knownPeersFilePath())
+			}
+		}
+		for id, known := range knownPeers {
+			if id != p.ID && known.Nickname == p.Nickname {
+				fmt.Printf("forgetting unpaired peer %s (ID %s): its nickname now belongs to ID %s\n", known.Nickname, id, p.ID)
+				delete(knownPeers, id)
+			}
+		}
+	}
+	now := time.Now().UTC()
+	known, exists := knownPeers[p.ID]
+	if !exists {
+		fmt.Printf("pairing with new peer %s (%s), ID %s\n", p.Nickname, p.IP, p.ID)
+		known.FirstSeen = now
+	} else if !known.pairedWith(secret) {
+		fmt.Printf("pairing again with peer %s (%s), ID %s: it proved it knows the current cluster secret\n", p.Nickname, p.IP, p.ID)
+	}
+	known.Nickname = p.Nickname
+	known.IP = p.IP
+	known.LastSeen = now
+	known.PairedWith = secretTag(secret)
+	knownPeers[p.ID] = known
+
+	jsonData, err := json.MarshalIndent(knownPeers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(knownPeersFilePath(), jsonData, 0644)
+}
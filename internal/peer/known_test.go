@@ -0,0 +1,31 @@
+package peer
+
+import "testing"
+
+func TestIsPaired(t *testing.T) {
+	knownPeersMutex.Lock()
+	knownPeers = map[string]KnownPeer{
+		"proven":     {Nickname: "laptop", PairedWith: secretTag("secret")},
+		"unproven":   {Nickname: "desktop"}, // pinned before pairing needed a proof
+		"old secret": {Nickname: "server", PairedWith: secretTag("old secret")},
+	}
+	knownPeersMutex.Unlock()
+	defer func() {
+		knownPeersMutex.Lock()
+		knownPeers = nil
+		knownPeersMutex.Unlock()
+	}()
+
+	if !IsPaired("proven", "secret") {
+		t.Error("peer that proved the secret should be paired")
+	}
+	for _, id := range []string{"unproven", "old secret", "unknown"} {
+		if IsPaired(id, "secret") {
+			t.Errorf("%s: peer that didn't prove the current secret shouldn't be paired", id)
+		}
+	}
+	// changing the secret unpairs every peer until it proves the new one
+	if IsPaired("proven", "new secret") || IsPaired("proven", "") {
+		t.Error("peer shouldn't stay paired once the secret changes")
+	}
+}
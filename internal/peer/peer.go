@@ -1,7 +1,6 @@
 package peer
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"sync"
@@ -21,7 +20,12 @@ const (
 var discoveredPeers []m.Peer
 var mutex sync.Mutex
 
-func DiscoverPeers() []m.Peer {
+// scans the local subnet for nodes that are set up with the same cluster secret as this one, pairing with each one found
+func DiscoverPeers(config c.Config) []m.Peer {
+	if config.GetClusterSecret() == "" {
+		fmt.Println("not searching for peers: no cluster secret configured")
+		return []m.Peer{}
+	}
 	localSubnet := network.GetLocalSubnetBase()
 	myIP := network.GetLocalIP()
 	fmt.Println("searching for peers on local subnet:", localSubnet)
@@ -34,7 +38,7 @@ func DiscoverPeers() []m.Peer {
 		}
 		wg.Add(1)
 		go func() {
-			scanIP(ip)
+			scanIP(ip, config)
 			wg.Done()
 		}()
 	}
@@ -44,77 +48,182 @@ func DiscoverPeers() []m.Peer {
 	return discoveredPeers
 }
 
-func scanIP(ip string) {
-	addr := net.JoinHostPort(ip, fmt.Sprintf("%v", c.PORT))
-	conn, err := net.DialTimeout("tcp", addr, time.Millisecond*time.Duration(c.MESSAGE_TIMEOUT_MS))
+func scanIP(ip string, config c.Config) {
+	conn, err := network.Dial(ip, c.PORT, time.Millisecond*time.Duration(c.MESSAGE_TIMEOUT_MS))
 	if err != nil {
 		return // connection failed
 	}
 	defer conn.Close()
 
 	// peer discovered
-	if success, p := crispHandshake(conn, ip); success {
+	if success, p := crispHandshake(conn, ip, config); success {
 		mutex.Lock()
 		discoveredPeers = append(discoveredPeers, p)
 		mutex.Unlock()
 	}
 }
 
-// exchange a crisp handshake with the IP to confirm that they are, in fact, your homie (peer)
-func crispHandshake(conn net.Conn, ip string) (bool, m.Peer) {
-	// send a handshake that just includes this nodes IP address
+// exchange a crisp handshake with the IP to confirm that they are, in fact, your homie (peer).
+// both nodes prove they know the cluster secret (see auth.go) before either one pairs with the other; this node proves it first.
+func crispHandshake(conn net.Conn, ip string, config c.Config) (bool, m.Peer) {
+	localID, err := network.LocalID()
+	if err != nil {
+		fmt.Println(err)
+		return false, m.Peer{}
+	}
+	remoteID, err := network.PeerID(conn)
+	if err != nil {
+		fmt.Println("error identifying peer:", err)
+		return false, m.Peer{}
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		fmt.Println(err)
+		return false, m.Peer{}
+	}
+
+	// send a handshake that includes this nodes IP address and a challenge for the peer
 	localAddr := conn.LocalAddr().String()
-	handshakeJson, err := json.Marshal(m.Handshake{
-		Type: c.TYPE_DISCOVER_PEER,
-		Data: localAddr,
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(c.MESSAGE_TIMEOUT_MS)))
+	err = network.WriteMessage(conn, m.Handshake{
+		Type:            c.TYPE_DISCOVER_PEER,
+		ProtocolVersion: c.PROTOCOL_VERSION,
+		Data:            localAddr,
+		Nickname:        config.Nickname,
+		Nonce:           nonce,
 	})
 	if err != nil {
 		fmt.Println(err)
 		return false, m.Peer{}
 	}
-	conn.Write(handshakeJson)
 
 	// wait for a response, or timeout
-	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(c.MESSAGE_TIMEOUT_MS)))
-	buf, err := network.ReadBuffer(conn, 1024)
-	if err != nil {
+	var respJson m.Handshake
+	if err := network.ReadMessageLimit(conn, &respJson, network.MAX_CONTROL_FRAME_SIZE); err != nil {
 		fmt.Println("error reading handshake response:", err)
 		return false, m.Peer{}
 	}
-	var respJson m.Handshake
-	err = json.Unmarshal(buf, &respJson)
+	if respJson.ProtocolVersion != c.PROTOCOL_VERSION {
+		fmt.Printf("ignoring peer %s: it speaks protocol version %v, not %v\n", ip, respJson.ProtocolVersion, c.PROTOCOL_VERSION)
+		return false, m.Peer{}
+	}
+	fmt.Printf("Peer response: %s\n", respJson.Data)
+
+	// we prove we know the cluster secret first, so the peer never hands out a proof to a node that hasn't proven anything
+	secret := config.GetClusterSecret()
+	err = network.WriteMessage(conn, m.Handshake{
+		Type:  c.TYPE_DISCOVER_PEER,
+		Proof: handshakeProof(secret, roleInitiator, nonce, respJson.Nonce, localID, remoteID),
+	})
 	if err != nil {
 		fmt.Println(err)
 		return false, m.Peer{}
 	}
-	fmt.Printf("Peer response: %s\n", respJson.Data)
-	// TODO: validate data in some way, to further authenticate peer node?
-	return true, m.Peer{
+	// once it accepts our proof, the peer answers with its own
+	var proof m.Handshake
+	if err := network.ReadMessageLimit(conn, &proof, network.MAX_CONTROL_FRAME_SIZE); err != nil {
+		fmt.Printf("peer %s didn't accept the handshake: %s\n", ip, err)
+		return false, m.Peer{}
+	}
+	expected := handshakeProof(secret, roleResponder, nonce, respJson.Nonce, localID, remoteID)
+	if err := verifyProof(proof.Proof, expected); err != nil {
+		fmt.Printf("ignoring peer %s: %s\n", ip, err)
+		return false, m.Peer{}
+	}
+
+	p := m.Peer{
+		ID:       remoteID,
 		IP:       ip,
 		Nickname: respJson.Nickname,
 	}
+	if err := pinPeer(p, secret); err != nil {
+		fmt.Println("rejecting peer:", err)
+		return false, m.Peer{}
+	}
+	return true, p
 }
 
 func RespondToHandshake(conn net.Conn, handshakeData m.Handshake, config c.Config) {
 	defer conn.Close()
 	fmt.Println("responding to handshake")
 
-	// send back handshake response
+	// nodes on a different version of the protocol can't understand each other
+	if handshakeData.ProtocolVersion != c.PROTOCOL_VERSION {
+		fmt.Printf("rejecting handshake: peer speaks protocol version %v, not %v\n", handshakeData.ProtocolVersion, c.PROTOCOL_VERSION)
+		network.WriteError(conn, fmt.Sprintf("unsupported protocol version %v; this node speaks version %v", handshakeData.ProtocolVersion, c.PROTOCOL_VERSION))
+		return
+	}
+	secret := config.GetClusterSecret()
+	if secret == "" {
+		fmt.Println("rejecting handshake: no cluster secret configured")
+		network.WriteError(conn, "handshake rejected")
+		return
+	}
+
+	// the peer is identified by the key it connected with
 	remoteIP := network.GetRemoteIP(conn)
-	bytes, err := json.Marshal(m.Handshake{
-		Type:     c.TYPE_DISCOVER_PEER,
-		Data:     remoteIP,        // echo their IP back, to confirm we are a legit node
-		Nickname: config.Nickname, // send nickname of this node
+	localID, err := network.LocalID()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	remoteID, err := network.PeerID(conn)
+	if err != nil {
+		fmt.Println("error identifying peer:", err)
+		return
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// send back handshake response, with a challenge for the peer. our own proof is only sent once the peer has proven it knows the secret,
+	// so a node that doesn't know it can't collect proofs to guess the secret from
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(c.MESSAGE_TIMEOUT_MS_LONG)))
+	err = network.WriteMessage(conn, m.Handshake{
+		Type:            c.TYPE_DISCOVER_PEER,
+		ProtocolVersion: c.PROTOCOL_VERSION,
+		Data:            remoteIP,        // echo their IP back
+		Nickname:        config.Nickname, // send nickname of this node
+		Nonce:           nonce,
 	})
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	conn.Write(bytes)
 
-	// add this IP to this nodes peer list
-	state.AddPeer(m.Peer{
+	// only pair with the peer, and send our own proof, once it proves it knows the secret
+	var proof m.Handshake
+	if err := network.ReadMessageLimit(conn, &proof, network.MAX_CONTROL_FRAME_SIZE); err != nil {
+		fmt.Println("error reading handshake proof:", err)
+		return
+	}
+	expected := handshakeProof(secret, roleInitiator, handshakeData.Nonce, nonce, remoteID, localID)
+	if err := verifyProof(proof.Proof, expected); err != nil {
+		fmt.Printf("rejecting handshake from %s: %s\n", remoteIP, err)
+		network.WriteError(conn, "handshake rejected")
+		return
+	}
+	p := m.Peer{
+		ID:       remoteID,
 		IP:       remoteIP,
 		Nickname: handshakeData.Nickname,
+	}
+	if err := pinPeer(p, secret); err != nil {
+		fmt.Println("rejecting handshake:", err)
+		network.WriteError(conn, "handshake rejected")
+		return
+	}
+	err = network.WriteMessage(conn, m.Handshake{
+		Type:  c.TYPE_DISCOVER_PEER,
+		Proof: handshakeProof(secret, roleResponder, handshakeData.Nonce, nonce, remoteID, localID),
 	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// add this peer to this nodes peer list
+	state.AddPeer(p)
 }
@@ -0,0 +1,206 @@
+// limits how fast files are sent to and received from other nodes, using token buckets.
+//
+// there is a global limit for uploads and downloads, and optionally a limit for each peer; a transfer has to stay within both.
+// the limits come from the config, and can be changed while transfers are running.
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+)
+
+// reads and writes are limited in pieces of at most this size, so data flows steadily rather than in bursts
+const maxPiece = 32 * 1024
+
+// a token bucket, allowing a number of bytes per second through
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second; 0 means unlimited
+	tokens float64 // bytes that can go through right now; negative if bytes are owed
+	last   time.Time
+}
+
+// makes a limiter allowing the given number of bytes per second through; 0 means unlimited
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// changes the number of bytes per second the limiter allows through; 0 means unlimited
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if float64(bytesPerSecond) == l.rate {
+		return
+	}
+	l.rate = float64(bytesPerSecond)
+	l.tokens = min(l.tokens, l.rate)
+	l.last = time.Now()
+}
+
+// waits until n bytes are allowed through
+func (l *Limiter) Wait(n int) {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	// at most a second's worth of bytes can build up while nothing is being transferred
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	time.Sleep(wait)
+}
+
+type reader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// wraps a reader so reading from it stays within the given limits
+func Reader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{r, limiters}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxPiece {
+		p = p[:maxPiece]
+	}
+	n, err := r.r.Read(p)
+	for _, limiter := range r.limiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
+
+type writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// wraps a writer so writing to it stays within the given limits
+func Writer(w io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{w, limiters}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), maxPiece)]
+		for _, limiter := range w.limiters {
+			limiter.Wait(len(piece))
+		}
+		n, err := w.w.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// the limiters for one direction of transfers; the global one, and one for each peer that has its own limit
+type limiters struct {
+	mutex  sync.Mutex
+	global *Limiter
+	peers  map[string]*Limiter
+}
+
+var (
+	uploads   = limiters{global: NewLimiter(0), peers: map[string]*Limiter{}}
+	downloads = limiters{global: NewLimiter(0), peers: map[string]*Limiter{}}
+)
+
+// gets the limiters that apply to sending files to the given peer
+func UploadLimiters(peerID string) []*Limiter {
+	return uploads.get(peerID)
+}
+
+// gets the limiters that apply to receiving files from the given peer
+func DownloadLimiters(peerID string) []*Limiter {
+	return downloads.get(peerID)
+}
+
+func (l *limiters) get(peerID string) []*Limiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if peer, exists := l.peers[peerID]; exists {
+		return []*Limiter{l.global, peer}
+	}
+	return []*Limiter{l.global}
+}
+
+// sets the limits from the config, as they are at the given time. transfers that are already running switch to the new limits right away.
+func Apply(config c.Config, now time.Time) {
+	global := currentLimits(config, now)
+	uploads.set(global.Upload, config.PeerRateLimits, func(limits c.RateLimits) int64 { return limits.Upload })
+	downloads.set(global.Download, config.PeerRateLimits, func(limits c.RateLimits) int64 { return limits.Download })
+}
+
+func (l *limiters) set(global int64, peerLimits map[string]c.RateLimits, limit func(c.RateLimits) int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.global.SetRate(global * 1024)
+	for peerID, limits := range peerLimits {
+		if peer, exists := l.peers[peerID]; exists {
+			peer.SetRate(limit(limits) * 1024)
+		} else {
+			l.peers[peerID] = NewLimiter(limit(limits) * 1024)
+		}
+	}
+	// peers whose limits were removed aren't limited anymore
+	for peerID, peer := range l.peers {
+		if _, exists := peerLimits[peerID]; !exists {
+			peer.SetRate(0)
+		}
+	}
+}
+
+// gets the global limits at the given time; the limits of the first schedule covering that time, or the normal limits otherwise
+func currentLimits(config c.Config, now time.Time) c.RateLimits {
+	minute := now.Hour()*60 + now.Minute()
+	for _, schedule := range config.RateLimitSchedule {
+		start, err := parseTimeOfDay(schedule.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseTimeOfDay(schedule.End)
+		if err != nil {
+			continue
+		}
+		inSchedule := start <= minute && minute < end
+		if end <= start {
+			// wraps past midnight, e.g. from 22:00 to 07:00
+			inSchedule = minute >= start || minute < end
+		}
+		if inSchedule {
+			return schedule.Limits
+		}
+	}
+	return config.RateLimits
+}
+
+// parses a time of day like "22:30", and returns the number of minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+)
+
+func TestLimiter(t *testing.T) {
+	// a second's worth of bytes goes through right away, and the rest at the limited rate
+	limiter := NewLimiter(100 * 1024)
+	start := time.Now()
+	if _, err := io.Copy(Writer(io.Discard, limiter), bytes.NewReader(make([]byte, 150*1024))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("writing 150 KiB at 100 KiB/s took %s; expected about half a second", elapsed)
+	}
+
+	// raising the limit takes effect right away
+	limiter.SetRate(0)
+	start = time.Now()
+	if _, err := io.Copy(io.Discard, Reader(bytes.NewReader(make([]byte, 1024*1024)), limiter)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("reading without a limit took %s", elapsed)
+	}
+}
+
+func TestCurrentLimits(t *testing.T) {
+	config := c.Config{
+		RateLimits: c.RateLimits{Upload: 100, Download: 200},
+		RateLimitSchedule: []c.RateLimitSchedule{
+			{Start: "22:00", End: "07:00", Limits: c.RateLimits{}},
+			{Start: "12:00", End: "13:00", Limits: c.RateLimits{Upload: 10, Download: 10}},
+		},
+	}
+	tests := []struct {
+		time     string
+		expected c.RateLimits
+	}{
+		{"09:30", config.RateLimits},
+		{"23:15", c.RateLimits{}},
+		{"03:00", c.RateLimits{}},
+		{"07:00", config.RateLimits},
+		{"12:30", c.RateLimits{Upload: 10, Download: 10}},
+		{"13:00", config.RateLimits},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse("15:04", test.time)
+		if limits := currentLimits(config, now); limits != test.expected {
+			t.Errorf("%s: expected limits %+v; got %+v", test.time, test.expected, limits)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	c "github.com/webbben/p2p-file-share/internal/config"
 	filetransfer "github.com/webbben/p2p-file-share/internal/file-transfer"
@@ -15,25 +19,94 @@ import (
 )
 
 // starts a server for TCP-based messages, and routes incoming messages to their correct functionality.
-func MessageServer(config c.Config) {
+//
+// connections are handled concurrently, up to c.MAX_CONNECTIONS at a time; further connections wait to be accepted until one finishes.
+// once ctx is cancelled, no new connections are accepted, and the server returns after the connections in progress are done
+// (or cut off, if they take longer than c.SHUTDOWN_TIMEOUT_MS).
+func MessageServer(ctx context.Context, config c.Config) {
 	port := c.PORT
-	server, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	server, err := network.Listen(port)
 	if err != nil {
 		fmt.Println("Error starting message server:", err)
 		return
 	}
-	defer server.Close()
-
 	log.Printf("TCP server listening on port %v\n", port)
 
+	// stop accepting connections on shutdown
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, c.MAX_CONNECTIONS)
+		open  = openConnections{conns: map[net.Conn]bool{}}
+	)
 	// accept and route incoming connections
 	for {
+		slots <- struct{}{}
 		conn, err := server.Accept()
 		if err != nil {
+			<-slots
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
 			log.Println("Error accepting connection:", err)
 			continue
 		}
-		handleConnection(conn, config)
+		open.add(conn)
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer func() {
+				open.remove(conn)
+				<-slots
+				wg.Done()
+			}()
+			handleConnection(conn, config)
+		}(conn)
+	}
+
+	// let the connections in progress finish, but don't wait on them forever
+	log.Println("message server shutting down; waiting for open connections to finish")
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Millisecond * time.Duration(c.SHUTDOWN_TIMEOUT_MS)):
+		log.Println("timed out waiting for open connections; closing them")
+		open.closeAll()
+		<-drained
+	}
+	log.Println("message server stopped")
+}
+
+// the connections the message server is handling, so they can be cut off on shutdown
+type openConnections struct {
+	conns map[net.Conn]bool
+	mutex sync.Mutex
+}
+
+func (o *openConnections) add(conn net.Conn) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.conns[conn] = true
+}
+
+func (o *openConnections) remove(conn net.Conn) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.conns, conn)
+}
+
+func (o *openConnections) closeAll() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for conn := range o.conns {
+		conn.Close()
 	}
 }
 
@@ -41,18 +114,33 @@ func MessageServer(config c.Config) {
 func handleConnection(conn net.Conn, config c.Config) {
 	defer conn.Close()
 
-	// read incoming data
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	// read the incoming message. a peer that connects but doesn't send anything doesn't get to hold on to the connection.
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(c.MESSAGE_TIMEOUT_MS_LONG))); err != nil {
+		log.Println("Error setting read deadline:", err)
+		return
+	}
+	id, err := network.PeerID(conn)
 	if err != nil {
-		log.Println("Error reading connection:", err)
+		log.Println("Error identifying peer:", err)
 		return
 	}
+	// nodes that haven't paired with this node can only send handshakes, which are small
+	paired := peer.IsPaired(id, config.GetClusterSecret())
+	limit := network.MAX_CONTROL_FRAME_SIZE
+	if paired {
+		limit = network.MAX_FRAME_SIZE
+	}
 	var msg map[string]interface{}
-	if err := json.Unmarshal(buf[:n], &msg); err != nil {
-		log.Println("Error parsing message:", err)
+	if err := network.ReadMessageLimit(conn, &msg, limit); err != nil {
+		log.Println("Error reading message:", err)
 		return
 	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		log.Println("Error clearing read deadline:", err)
+		return
+	}
+	// from here on, the connection stays open for as long as data keeps moving, so a peer that stalls mid-transfer doesn't hold on to it
+	conn = network.WithIdleTimeout(conn, time.Millisecond*time.Duration(c.CONNECTION_IDLE_MS))
 
 	// route by message type
 	remoteIP := network.GetRemoteIP(conn)
@@ -61,6 +149,24 @@ func handleConnection(conn net.Conn, config c.Config) {
 		log.Println("Error handling connection: Message missing type property")
 		return
 	}
+	// apart from handshakes, only peers that have paired with this node get a response,
+	// and only about the shares that are synced with them
+	var share c.Share
+	if messageType != c.TYPE_DISCOVER_PEER {
+		if !paired {
+			log.Printf("Rejecting %s from unpaired node at %s\n", messageType, remoteIP)
+			network.WriteError(conn, "not paired with this node")
+			return
+		}
+		shareID, _ := msg["share"].(string)
+		var exists bool
+		share, exists = config.GetShare(shareID)
+		if !exists || !share.HasMember(id) {
+			log.Printf("Rejecting %s for share %q from %s: not a member of the share\n", messageType, shareID, remoteIP)
+			network.WriteError(conn, "unknown share: "+shareID)
+			return
+		}
+	}
 	switch messageType {
 	case c.TYPE_DISCOVER_PEER:
 		var structMsg m.Handshake
@@ -75,7 +181,21 @@ func handleConnection(conn net.Conn, config c.Config) {
 			fmt.Println("error decoding file request data:", err)
 			return
 		}
-		filetransfer.SendFile(conn, structMsg.File)
+		filetransfer.SendFile(conn, config.ForShare(share), structMsg, syncdir.GetFileVersion(share.ID, structMsg.File), syncdir.GetChunkList(share.ID, structMsg.File))
+	case c.TYPE_DELTA_REQUEST:
+		var structMsg m.DeltaRequest
+		if err := mapToStruct(msg, &structMsg); err != nil {
+			fmt.Println("error decoding delta request data:", err)
+			return
+		}
+		filetransfer.SendFileDelta(conn, config.ForShare(share), structMsg, syncdir.GetFileVersion(share.ID, structMsg.File), syncdir.GetChunkList(share.ID, structMsg.File))
+	case c.TYPE_CHUNK_LIST:
+		var structMsg m.FileRequest
+		if err := mapToStruct(msg, &structMsg); err != nil {
+			fmt.Println("error decoding chunk list request data:", err)
+			return
+		}
+		filetransfer.SendChunkList(conn, structMsg.File, syncdir.GetChunkList(share.ID, structMsg.File))
 	case c.TYPE_FILE_CHANGE_NOTIFY:
 		var structMsg m.NotifyFileChange
 		if err := mapToStruct(msg, &structMsg); err != nil {
@@ -83,7 +203,14 @@ func handleConnection(conn net.Conn, config c.Config) {
 			return
 		}
 		fmt.Println("file change!", structMsg)
-		syncdir.HandleRemoteFileChange(structMsg, remoteIP, config)
+		// the change is fetched from the node that sent it, and nobody else is accepted at its IP
+		syncdir.QueueRemoteFileChange(structMsg, m.Peer{ID: id, IP: remoteIP}, config.ForShare(share))
+	case c.TYPE_SCAN_FILES:
+		if err := network.WriteMessage(conn, syncdir.GetFileSummary(share.ID)); err != nil {
+			fmt.Println("error sending file summary:", err)
+		}
+	default:
+		network.WriteError(conn, "unknown message type: "+messageType)
 	}
 }
 
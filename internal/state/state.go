@@ -10,7 +10,7 @@ import (
 )
 
 type State struct {
-	HistoricPeersList map[string]time.Time
+	HistoricPeersList map[string]time.Time // when each peer was last seen, by ID
 	CurrentPeersList  []m.Peer
 	LastPeerSearch    time.Time
 }
@@ -21,8 +21,19 @@ var (
 		CurrentPeersList:  []m.Peer{},
 	}
 	stateMutex sync.Mutex
+
+	peerJoinedHandler func(m.Peer) // called whenever a peer (re)appears in the current peers list
 )
 
+// registers a function to be called whenever a peer that wasn't in the current peers list appears, such as when a node starts up or reconnects.
+// the function is called in its own goroutine.
+func OnPeerJoined(handler func(m.Peer)) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	peerJoinedHandler = handler
+}
+
 // sets the current peers list
 func SetPeers(peers []m.Peer) {
 	stateMutex.Lock()
@@ -31,9 +42,12 @@ func SetPeers(peers []m.Peer) {
 	now := time.Now().UTC()
 	for _, peer := range peers {
 		fmt.Println(peer)
-		state.HistoricPeersList[peer.IP] = now
+		state.HistoricPeersList[peer.Key()] = now
+		if !isCurrentPeer(peer) {
+			peerJoined(peer)
+		}
 	}
-	state.CurrentPeersList = peers
+	state.CurrentPeersList = append([]m.Peer{}, peers...)
 	state.LastPeerSearch = now
 }
 
@@ -42,26 +56,55 @@ func AddPeer(peer m.Peer) {
 	stateMutex.Lock()
 	defer stateMutex.Unlock()
 
-	state.HistoricPeersList[peer.IP] = time.Now().UTC()
+	state.HistoricPeersList[peer.Key()] = time.Now().UTC()
+	if isCurrentPeer(peer) {
+		return // peer is already in the list
+	}
+	state.CurrentPeersList = append(state.CurrentPeersList, peer)
+	peerJoined(peer)
+}
+
+// whether the peer is in the current peers list. the caller must hold stateMutex.
+func isCurrentPeer(peer m.Peer) bool {
 	for _, p := range state.CurrentPeersList {
-		if p.IP == peer.IP {
-			return // peer is already in the list
+		if p.Key() == peer.Key() {
+			return true
 		}
 	}
-	state.CurrentPeersList = append(state.CurrentPeersList, peer)
+	return false
+}
+
+// the caller must hold stateMutex.
+func peerJoined(peer m.Peer) {
+	if peerJoinedHandler != nil {
+		go peerJoinedHandler(peer)
+	}
 }
 
 // getst he current list of peers
 func GetPeers() []m.Peer {
-	return state.CurrentPeersList
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	return append([]m.Peer{}, state.CurrentPeersList...)
 }
 
-// gets a map of all peers this node has discovered
+// gets a map of all peers this node has discovered, by ID
 func GetHistoricalPeers() map[string]time.Time {
-	return state.HistoricPeersList
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	peers := make(map[string]time.Time, len(state.HistoricPeersList))
+	for ip, lastSeen := range state.HistoricPeersList {
+		peers[ip] = lastSeen
+	}
+	return peers
 }
 
 // determines if the peer data is stale and should be refreshed
 func PeerDataIsStale() bool {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
 	return time.Since(state.LastPeerSearch) > (time.Minute * 5)
 }
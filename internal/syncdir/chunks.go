@@ -0,0 +1,90 @@
+package syncdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/webbben/p2p-file-share/internal/chunker"
+	c "github.com/webbben/p2p-file-share/internal/config"
+	filetransfer "github.com/webbben/p2p-file-share/internal/file-transfer"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// hashes a file, and splits it into content-defined chunks.
+// returns the SHA-256 of the whole file, and the chunks it's made of.
+func chunkFile(fullPath string) (string, []m.Chunk, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	fileHash := sha256.New()
+	chunks := []m.Chunk{}
+	split := chunker.New(io.TeeReader(file, fileHash))
+	var offset int64
+	for {
+		chunk, err := split.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		hash := sha256.Sum256(chunk)
+		chunks = append(chunks, m.Chunk{
+			Offset: offset,
+			Length: int64(len(chunk)),
+			Hash:   hex.EncodeToString(hash[:]),
+		})
+		offset += int64(len(chunk))
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), chunks, nil
+}
+
+// gets a header describing a file in a share as it is in the index, including the chunks it's made of. returns nil if the file isn't indexed.
+func GetChunkList(shareID string, filename string) *m.FileTransferHeader {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	entry, exists := shareIndex(shareID)[filename]
+	if !exists || entry.Deleted || entry.IsDir || entry.LinkTarget != "" || !entry.isHashed() {
+		return nil
+	}
+	return &m.FileTransferHeader{
+		File:    filename,
+		Version: entry.Version.Copy(),
+		Mode:    entry.Mode,
+		ModTime: entry.ModTime,
+		Size:    entry.Size,
+		Hash:    entry.Hash,
+		Chunks:  entry.Chunks,
+	}
+}
+
+// makes a function for finding chunks that are already somewhere in this node's shares, so they don't have to be transferred again
+func chunkLocator(config c.Config) filetransfer.ChunkLocator {
+	type location struct {
+		fullPath string
+		offset   int64
+	}
+	locations := map[string]location{}
+	for _, share := range config.GetShares() {
+		for filename, entry := range getIndexEntries(share.ID) {
+			if entry.Deleted || entry.IsDir || entry.LinkTarget != "" {
+				continue
+			}
+			for _, chunk := range entry.Chunks {
+				locations[chunk.Hash] = location{filepath.Join(share.Path, filename), chunk.Offset}
+			}
+		}
+	}
+	return func(hash string) (string, int64, bool) {
+		location, exists := locations[hash]
+		return location.fullPath, location.offset, exists
+	}
+}
@@ -0,0 +1,131 @@
+package syncdir
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// handles a remote change that is concurrent with the local version of the file.
+//
+// both nodes have to settle on the same outcome without talking to each other, so a fixed rule picks the winning version.
+// the node holding the losing version keeps it as a conflict copy next to the original, and then takes the winning version.
+// the node holding the winning version doesn't need to do anything.
+func handleConflict(fileChange m.NotifyFileChange, localVersion m.VersionVector, p m.Peer, config c.Config) {
+	filePath := getFullFilePath(fileChange.File, config)
+	if filePath == "" {
+		log.Println("failed to handle conflict; no filepath provided")
+		return
+	}
+	localExists := true
+	if _, err := os.Lstat(filePath); errors.Is(err, os.ErrNotExist) {
+		localExists = false
+	}
+
+	switch {
+	case fileChange.IsDir && fileChange.Change == FILE_MOD:
+		// both sides created the directory; directories don't have contents of their own to conflict
+		applyRemoteDirectory(fileChange, localVersion, config)
+		return
+	case fileChange.IsDir:
+		log.Printf("CONFLICT: %s: concurrent directory change; keeping local directory\n", fileChange.File)
+		return
+	case fileChange.Change == FILE_DEL && !localExists:
+		// both sides deleted the file; nothing to keep
+		recordDeletion(config.ShareID, fileChange.File, localVersion.Merge(fileChange.Version), false, fileChange.Node, fileChange.Time)
+		return
+	case fileChange.Change == FILE_DEL:
+		// a modification always wins over a deletion, so the peer will restore the file from us
+		log.Printf("CONFLICT: %s: deleted remotely but modified locally; keeping local copy\n", fileChange.File)
+		return
+	case !localExists:
+		// deleted locally but modified remotely; restore the remote copy
+		log.Printf("CONFLICT: %s: deleted locally but modified remotely; restoring remote copy\n", fileChange.File)
+		version, err := receiveFileChange(fileChange, p, config, nil)
+		if err != nil {
+			log.Println("error requesting file change:", err)
+			return
+		}
+		setFileVersion(config.ShareID, fileChange.File, localVersion.Merge(version), false)
+		return
+	}
+
+	if !remoteWinsConflict(localVersion, fileChange.Version) {
+		log.Printf("CONFLICT: %s: concurrent change from %s; keeping local version %s (the peer keeps its version %s as a conflict copy)\n", fileChange.File, p.IP, localVersion, fileChange.Version)
+		return
+	}
+
+	// take the remote version, and keep the local version as a conflict copy. the remote version is received into the staging area first,
+	// and the local version is only moved aside once the remote one is ready to take its place; until then the file stays where it is,
+	// and the parts of it that didn't change don't have to be transferred.
+	conflictFile := conflictFileName(fileChange.File, config.Nickname, time.Now())
+	conflictPath := getFullFilePath(conflictFile, config)
+	keptLocal := false
+	keepLocalCopy := func(string) error {
+		if keptLocal {
+			return nil // already moved aside by an earlier attempt
+		}
+		if err := os.Rename(filePath, conflictPath); err != nil {
+			return fmt.Errorf("failed to create conflict copy: %w", err)
+		}
+		keptLocal = true
+		return nil
+	}
+	version, err := receiveFileChange(fileChange, p, config, keepLocalCopy)
+	if err != nil {
+		log.Println("error requesting file change:", err)
+		// the remote version couldn't be moved into place after all; put the local version back so the file isn't lost
+		if keptLocal {
+			if err := os.Rename(conflictPath, filePath); err != nil {
+				log.Println("failed to restore local version from conflict copy:", err)
+			}
+		}
+		return
+	}
+	setFileVersion(config.ShareID, fileChange.File, localVersion.Merge(version), false)
+	log.Printf("CONFLICT: %s: concurrent change from %s; local version %s saved as %s\n", fileChange.File, p.IP, localVersion, conflictFile)
+
+	// the conflict copy is a new file, so share it like any other
+	queueFileChange(FileChange{
+		File:     conflictFile,
+		FullPath: conflictPath,
+		Change:   FILE_MOD,
+	}, config)
+}
+
+// decides which of two concurrent versions wins. every node has to come to the same decision,
+// so the version with the most changes wins, and ties are broken by comparing the vectors themselves.
+func remoteWinsConflict(localVersion, remoteVersion m.VersionVector) bool {
+	localTotal, remoteTotal := versionTotal(localVersion), versionTotal(remoteVersion)
+	if localTotal != remoteTotal {
+		return remoteTotal > localTotal
+	}
+	return remoteVersion.String() > localVersion.String()
+}
+
+func versionTotal(version m.VersionVector) uint64 {
+	var total uint64
+	for _, count := range version {
+		total += count
+	}
+	return total
+}
+
+// gets the name of the conflict copy for a file, e.g. "notes (conflict from laptop 2024-01-02 150405).txt"
+func conflictFileName(filename string, nickname string, t time.Time) string {
+	dir, base := filepath.Split(filename)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	if name == "" {
+		// dotfiles like ".bashrc" don't have an extension
+		name, ext = base, ""
+	}
+	return dir + fmt.Sprintf("%s (conflict from %s %s)%s", name, nickname, t.Format("2006-01-02 150405"), ext)
+}
@@ -0,0 +1,36 @@
+package syncdir
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+func TestConflictFileName(t *testing.T) {
+	when := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	testCases := map[string]string{
+		"notes.txt":            "notes (conflict from laptop 2024-01-02 150405).txt",
+		"sub/dir/notes.tar.gz": "sub/dir/notes.tar (conflict from laptop 2024-01-02 150405).gz",
+		"README":               "README (conflict from laptop 2024-01-02 150405)",
+		".bashrc":              ".bashrc (conflict from laptop 2024-01-02 150405)",
+	}
+	for filename, exp := range testCases {
+		if got := conflictFileName(filename, "laptop", when); got != exp {
+			t.Errorf("%s: exp %q, got %q", filename, exp, got)
+		}
+	}
+}
+
+func TestRemoteWinsConflict(t *testing.T) {
+	a := m.VersionVector{"a": 2, "b": 1}
+	b := m.VersionVector{"a": 1, "b": 2}
+	// both nodes must agree on the winner, no matter which side they're on
+	if remoteWinsConflict(a, b) == remoteWinsConflict(b, a) {
+		t.Error("nodes disagree on the winner of a tied conflict")
+	}
+	more := m.VersionVector{"a": 1, "b": 3}
+	if !remoteWinsConflict(a, more) || remoteWinsConflict(more, a) {
+		t.Error("the version with more changes should win")
+	}
+}
@@ -0,0 +1,434 @@
+package syncdir
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// what this node knows about a file in the shared directory
+type IndexEntry struct {
+	Size    int64           `json:"size"`
+	ModTime time.Time       `json:"mtime"`
+	Mode    os.FileMode     `json:"mode"`
+	Hash    string          `json:"hash"` // SHA-256 of the file contents; empty for directories
+	IsDir   bool            `json:"is_dir"`
+	Version m.VersionVector `json:"version"`
+	Deleted bool            `json:"deleted"` // whether the latest version of the file is a deletion
+
+	LinkTarget string    `json:"link_target,omitempty"` // for symbolic links synced as links, the path the link points to
+	Chunks     []m.Chunk `json:"-"`                     // the content-defined chunks the file is made of; saved in the chunk store rather than the index
+
+	// in a receive-only share, whether the file was changed on this node. such changes aren't versioned or sent to other nodes,
+	// and the next remote change to the file overwrites them.
+	LocalChange bool `json:"local_change,omitempty"`
+
+	// the following are only set for deleted files, so that the deletion (tombstone) isn't forgotten until every peer knows about it
+	DeletedBy string          `json:"deleted_by,omitempty"` // ID of the node that deleted the file
+	DeletedAt time.Time       `json:"deleted_at,omitempty"`
+	AckedBy   map[string]bool `json:"acked_by,omitempty"` // IDs of the peers known to have the deletion
+}
+
+var (
+	fileIndexes     map[string]map[string]IndexEntry = map[string]map[string]IndexEntry{} // index of all files and their info, by share ID
+	fileIndexPath   string                                                                // where the index is saved; if empty, it is only kept in memory
+	fileIndexDirty  bool                                                                  // whether the index has changes that haven't been written to disk yet
+	fileChunksDirty bool                                                                  // whether any chunk lists changed since the chunk store was last written
+	fileIndexFlush  *time.Timer                                                           // writes the changes once it fires
+	fileIndexMutex  sync.Mutex
+)
+
+// how long changes to the index are collected before they're written to disk
+const indexFlushDelay = 2 * time.Second
+
+// the index as it's saved on disk
+type savedFileIndex struct {
+	Shares map[string]map[string]IndexEntry `json:"shares"`
+}
+
+// loads the saved file index from the given file. future changes to the index are saved to this same file (see saveFileIndex).
+func LoadFileIndex(path string) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	// don't lose changes that were meant for the previous index
+	writeFileIndex()
+	fileIndexPath = path
+	jsonData, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("failed to read file index:", err)
+		}
+		return
+	}
+	var saved savedFileIndex
+	if err := json.Unmarshal(jsonData, &saved); err != nil {
+		log.Println("failed to parse file index:", err)
+		return
+	}
+	if saved.Shares == nil {
+		// an index from before shares existed; its files are in the default share
+		index := map[string]IndexEntry{}
+		if err := json.Unmarshal(jsonData, &index); err != nil {
+			log.Println("failed to parse file index:", err)
+			return
+		}
+		saved.Shares = map[string]map[string]IndexEntry{c.DEFAULT_SHARE_ID: index}
+	}
+	fileIndexes = saved.Shares
+	loadChunkStore()
+}
+
+// where the chunk lists of the indexed files are saved, next to the index itself.
+// they only change along with file contents, so they're kept out of the index to keep it small to write.
+func chunkStorePath() string {
+	return strings.TrimSuffix(fileIndexPath, filepath.Ext(fileIndexPath)) + ".chunks.json"
+}
+
+// fills in the chunk lists of the indexed files from the chunk store. files whose chunks are missing are hashed again when the index is refreshed.
+// the caller must hold fileIndexMutex.
+func loadChunkStore() {
+	jsonData, err := os.ReadFile(chunkStorePath())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("failed to read chunk store:", err)
+		}
+		return
+	}
+	chunkLists := map[string][]m.Chunk{}
+	if err := json.Unmarshal(jsonData, &chunkLists); err != nil {
+		log.Println("failed to parse chunk store:", err)
+		return
+	}
+	for _, index := range fileIndexes {
+		for filename, entry := range index {
+			if chunks, exists := chunkLists[entry.Hash]; exists && entry.Hash != "" {
+				entry.Chunks = chunks
+				index[filename] = entry
+			}
+		}
+	}
+}
+
+// gets the index of a share, creating it if it doesn't exist yet. the caller must hold fileIndexMutex.
+func shareIndex(shareID string) map[string]IndexEntry {
+	index, exists := fileIndexes[shareID]
+	if !exists {
+		index = map[string]IndexEntry{}
+		fileIndexes[shareID] = index
+	}
+	return index
+}
+
+func GetIndexedFileInfo(shareID string, filename string) *IndexEntry {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry, exists := index[filename]
+	if !exists {
+		log.Println("file is not indexed:", filename)
+		return nil
+	}
+	entry.Version = entry.Version.Copy()
+	return &entry
+}
+
+// updates the index entry of a file from its current state on disk, and returns the updated entry.
+// info is optional; if not given, the file is stat'ed.
+func indexFile(shareID string, filename string, fullPath string, info os.FileInfo) (IndexEntry, error) {
+	var err error
+	if info == nil {
+		if info, err = statFile(fullPath); err != nil {
+			return IndexEntry{}, err
+		}
+	}
+	linkTarget := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkTarget, err = os.Readlink(fullPath); err != nil {
+			return IndexEntry{}, err
+		}
+	}
+	fileIndexMutex.Lock()
+	entry := shareIndex(shareID)[filename]
+	fileIndexMutex.Unlock()
+
+	contentsUnchanged := entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) && entry.IsDir == info.IsDir() && entry.LinkTarget == linkTarget && !entry.Deleted && entry.isHashed()
+	if contentsUnchanged && entry.Mode == info.Mode() {
+		return entry, nil
+	}
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	entry.Mode = info.Mode()
+	entry.IsDir = info.IsDir()
+	entry.LinkTarget = linkTarget
+	if !contentsUnchanged {
+		entry.Hash = ""
+		entry.Chunks = nil
+	}
+	if linkTarget != "" {
+		entry.Hash = hashLinkTarget(linkTarget)
+	} else if !entry.IsDir && !contentsUnchanged {
+		hash, chunks, err := chunkFile(fullPath)
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		entry.Hash = hash
+		entry.Chunks = chunks
+	}
+
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+	// keep whatever version was recorded while we were hashing
+	index := shareIndex(shareID)
+	current := index[filename]
+	entry.Version = current.Version
+	entry.Deleted = current.Deleted
+	entry.DeletedBy = current.DeletedBy
+	entry.DeletedAt = current.DeletedAt
+	entry.AckedBy = current.AckedBy
+	entry.LocalChange = current.LocalChange
+	index[filename] = entry
+	if !contentsUnchanged && !entry.IsDir && linkTarget == "" {
+		fileChunksDirty = true
+	}
+	saveFileIndex()
+	return entry, nil
+}
+
+// gets the current version vector of a file. files that haven't been versioned yet have an empty vector.
+func GetFileVersion(shareID string, filename string) m.VersionVector {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	return shareIndex(shareID)[filename].Version.Copy()
+}
+
+// sets the version of a file that currently exists
+func setFileVersion(shareID string, filename string, version m.VersionVector, isDir bool) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry := index[filename]
+	entry.Version = version.Copy()
+	entry.IsDir = isDir
+	entry.LocalChange = false
+	entry.clearTombstone()
+	index[filename] = entry
+	saveFileIndex()
+}
+
+// records that a file was deleted, and sets the version of the deletion
+func recordDeletion(shareID string, filename string, version m.VersionVector, isDir bool, deletedBy string, deletedAt time.Time) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry := index[filename]
+	entry.Version = version.Copy()
+	entry.IsDir = isDir
+	entry.LocalChange = false
+	entry.setTombstone(deletedBy, deletedAt)
+	index[filename] = entry
+	saveFileIndex()
+}
+
+// records a change made to a file by the given node, and returns the file's new version
+func bumpFileVersion(shareID string, filename string, nodeID string, isDir bool, deleted bool) m.VersionVector {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry := index[filename]
+	entry.Version = entry.Version.Increment(nodeID)
+	entry.IsDir = isDir
+	entry.LocalChange = false
+	if deleted {
+		entry.setTombstone(nodeID, time.Now().UTC())
+	} else {
+		entry.clearTombstone()
+	}
+	index[filename] = entry
+	saveFileIndex()
+	return entry.Version.Copy()
+}
+
+// flags a file in a receive-only share as changed on this node, without recording the change in its version
+func markLocalChange(shareID string, filename string, isDir bool) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry := index[filename]
+	entry.IsDir = isDir
+	entry.LocalChange = true
+	index[filename] = entry
+	saveFileIndex()
+}
+
+// marks every file nested under a deleted directory as deleted too.
+// if bump is true, the deletion is recorded as a change made by deletedBy.
+func markNestedFilesDeleted(shareID string, dir string, deletedBy string, deletedAt time.Time, bump bool) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	prefix := dir + string(os.PathSeparator)
+	for filename, entry := range index {
+		if !strings.HasPrefix(filename, prefix) || entry.Deleted {
+			continue
+		}
+		if bump {
+			entry.Version = entry.Version.Increment(deletedBy)
+		}
+		entry.setTombstone(deletedBy, deletedAt)
+		index[filename] = entry
+	}
+	saveFileIndex()
+}
+
+// moves the index entry of a renamed file (and for directories, the entries of everything nested inside it) to the new path.
+// the old path is left with a tombstone, and the change is recorded as made by the given node.
+//
+// returns the version of the deletion from the old path, and the version of the file at its new path.
+func renameIndexEntry(shareID string, oldName string, newName string, nodeID string, renamedAt time.Time) (m.VersionVector, m.VersionVector) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	renamed := map[string]string{oldName: newName}
+	if index[oldName].IsDir {
+		prefix := oldName + string(os.PathSeparator)
+		for filename, entry := range index {
+			if strings.HasPrefix(filename, prefix) && !entry.Deleted {
+				renamed[filename] = filepath.Join(newName, strings.TrimPrefix(filename, prefix))
+			}
+		}
+	}
+	for oldFilename, newFilename := range renamed {
+		oldEntry := index[oldFilename]
+		newEntry := oldEntry
+		newEntry.Version = index[newFilename].Version.Merge(oldEntry.Version).Increment(nodeID)
+		newEntry.clearTombstone()
+		index[newFilename] = newEntry
+
+		oldEntry.Version = oldEntry.Version.Increment(nodeID)
+		oldEntry.setTombstone(nodeID, renamedAt)
+		index[oldFilename] = oldEntry
+	}
+	saveFileIndex()
+	return index[oldName].Version.Copy(), index[newName].Version.Copy()
+}
+
+// whether the entry has the hashes of the file's current contents; directories don't have any contents to hash
+func (entry IndexEntry) isHashed() bool {
+	if entry.IsDir {
+		return true
+	}
+	if entry.Hash == "" {
+		return false
+	}
+	// entries indexed before files were split into chunks need to be hashed again
+	return entry.LinkTarget != "" || entry.Size == 0 || len(entry.Chunks) > 0
+}
+
+func (entry *IndexEntry) setTombstone(deletedBy string, deletedAt time.Time) {
+	entry.Deleted = true
+	entry.DeletedBy = deletedBy
+	entry.DeletedAt = deletedAt
+	entry.AckedBy = nil
+}
+
+func (entry *IndexEntry) clearTombstone() {
+	entry.Deleted = false
+	entry.DeletedBy = ""
+	entry.DeletedAt = time.Time{}
+	entry.AckedBy = nil
+}
+
+// gets a copy of all index entries
+func getIndexEntries(shareID string) map[string]IndexEntry {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entries := make(map[string]IndexEntry, len(index))
+	for filename, entry := range index {
+		entry.Version = entry.Version.Copy()
+		entries[filename] = entry
+	}
+	return entries
+}
+
+// marks the index as changed, so it's written to disk shortly. changes made in quick succession (e.g. while indexing a whole directory)
+// are written together, rather than rewriting the whole index for each one. the caller must hold fileIndexMutex.
+func saveFileIndex() {
+	if fileIndexPath == "" {
+		return
+	}
+	fileIndexDirty = true
+	if fileIndexFlush == nil {
+		fileIndexFlush = time.AfterFunc(indexFlushDelay, FlushFileIndex)
+	}
+}
+
+// writes any unsaved changes to the index to disk right away, e.g. before the node shuts down
+func FlushFileIndex() {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	writeFileIndex()
+}
+
+// writes the index to disk if it has unsaved changes. the caller must hold fileIndexMutex.
+func writeFileIndex() {
+	if fileIndexFlush != nil {
+		fileIndexFlush.Stop()
+		fileIndexFlush = nil
+	}
+	if !fileIndexDirty || fileIndexPath == "" {
+		return
+	}
+	fileIndexDirty = false
+	if err := writeJSONFile(fileIndexPath, savedFileIndex{Shares: fileIndexes}); err != nil {
+		log.Println("failed to save file index:", err)
+	}
+	if !fileChunksDirty {
+		return
+	}
+	fileChunksDirty = false
+	// only the chunk lists of files still in the index are kept
+	chunkLists := map[string][]m.Chunk{}
+	for _, index := range fileIndexes {
+		for _, entry := range index {
+			if len(entry.Chunks) > 0 {
+				chunkLists[entry.Hash] = entry.Chunks
+			}
+		}
+	}
+	if err := writeJSONFile(chunkStorePath(), chunkLists); err != nil {
+		log.Println("failed to save chunk store:", err)
+	}
+}
+
+// writes data to a file as JSON. it's written to a temp file first, so a crash mid-write doesn't corrupt the file.
+func writeJSONFile(path string, data interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, jsonData, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
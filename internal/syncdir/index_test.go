@@ -0,0 +1,181 @@
+package syncdir
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+func TestFileIndex(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testindex")
+	if err := util.EnsureDir(filepath.Join(testdir, "sub")); err != nil {
+		t.Error("failed to create test directory:", err)
+		return
+	}
+	defer os.RemoveAll(testdir)
+	indexPath := filepath.Join(wd, "testindex.json")
+	defer os.Remove(indexPath)
+	defer os.Remove(filepath.Join(wd, "testindex.chunks.json"))
+
+	if err := os.WriteFile(filepath.Join(testdir, "sub", "a.txt"), []byte("some text"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	LoadFileIndex(indexPath)
+	defer LoadFileIndex("")
+	indexTestDir(c.DEFAULT_SHARE_ID, testdir)
+
+	entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filepath.Join("sub", "a.txt"))
+	if entry == nil {
+		t.Error("file wasn't indexed")
+		return
+	}
+	// sha256 of "some text"
+	if entry.Hash != "b94f6f125c79e3a5ffaa826f584c10d52ada669e6762051b826b55776d05aed2" {
+		t.Error("unexpected hash:", entry.Hash)
+	}
+	if entry.Size != 9 || entry.IsDir {
+		t.Errorf("unexpected file info: %+v", entry)
+	}
+	if dirEntry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, "sub"); dirEntry == nil || !dirEntry.IsDir {
+		t.Error("directory wasn't indexed as a directory")
+	}
+
+	// changes are written to disk together, not one at a time
+	if _, err := os.Stat(indexPath); err == nil {
+		t.Error("index was written before it was flushed")
+	}
+
+	// versions are kept when the index is refreshed, and the index survives a restart
+	bumpFileVersion(c.DEFAULT_SHARE_ID, filepath.Join("sub", "a.txt"), "node", false, false)
+	indexTestDir(c.DEFAULT_SHARE_ID, testdir)
+	FlushFileIndex()
+	LoadFileIndex(indexPath)
+	entry = GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filepath.Join("sub", "a.txt"))
+	if entry == nil || entry.Version["node"] != 1 || entry.Hash == "" {
+		t.Errorf("index wasn't saved correctly: %+v", entry)
+		return
+	}
+	// chunk lists are saved separately, rather than with every write of the index
+	if len(entry.Chunks) == 0 || !entry.isHashed() {
+		t.Errorf("chunk lists weren't restored from the chunk store: %+v", entry)
+	}
+	indexData, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Error("failed to read saved index:", err)
+		return
+	}
+	if strings.Contains(string(indexData), `"offset"`) {
+		t.Error("chunk lists were saved in the index")
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testmodes")
+	if err := util.EnsureDir(testdir); err != nil {
+		t.Error("failed to create test directory:", err)
+		return
+	}
+	defer os.RemoveAll(testdir)
+	share := c.Share{ID: "modes", Path: testdir, Mode: c.SYNC_RECEIVE_ONLY}
+	config := c.Config{Shares: []c.Share{share}}.ForShare(share)
+
+	// local changes to a receive-only share are flagged, but not versioned or sent
+	if err := os.WriteFile(filepath.Join(testdir, "mirror.txt"), []byte("local edit"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	changedFiles[share.ID] = []FileChange{{File: "mirror.txt", Change: FILE_MOD}}
+	shipFileChanges(config)
+	entry := GetIndexedFileInfo(share.ID, "mirror.txt")
+	if entry == nil || !entry.LocalChange || !entry.Version.IsEmpty() || entry.Hash == "" {
+		t.Errorf("local change wasn't flagged: %+v", entry)
+		return
+	}
+	// until a remote change overwrites it
+	setFileVersion(share.ID, "mirror.txt", m.VersionVector{"source": 1}, false)
+	if entry := GetIndexedFileInfo(share.ID, "mirror.txt"); entry == nil || entry.LocalChange {
+		t.Errorf("remote change should clear the local change flag: %+v", entry)
+	}
+
+	// a send-only share never takes remote changes
+	share.Mode = c.SYNC_SEND_ONLY
+	config = c.Config{Shares: []c.Share{share}}.ForShare(share)
+	HandleRemoteFileChange(m.NotifyFileChange{
+		File:    "mirror.txt",
+		Change:  FILE_DEL,
+		Version: m.VersionVector{"source": 1, "laptop": 1},
+	}, m.Peer{ID: "laptop", IP: "10.0.0.5"}, config)
+	if _, err := os.Stat(filepath.Join(testdir, "mirror.txt")); err != nil {
+		t.Error("send-only share applied a remote deletion:", err)
+	}
+	if version := GetFileVersion(share.ID, "mirror.txt"); version["laptop"] != 0 {
+		t.Error("send-only share took a remote version:", version)
+	}
+
+	// modes for specific peers take precedence over the share's mode
+	share.PeerModes = map[string]string{"laptop": c.SYNC_RECEIVE_ONLY}
+	if share.GetSyncMode("laptop") != c.SYNC_RECEIVE_ONLY || share.GetSyncMode("other") != c.SYNC_SEND_ONLY {
+		t.Error("unexpected sync modes:", share.GetSyncMode("laptop"), share.GetSyncMode("other"))
+	}
+
+	// a receive-only share that sends to one peer versions its local changes, so they can be sent to that peer
+	share.Mode = c.SYNC_RECEIVE_ONLY
+	share.PeerModes = map[string]string{"laptop": c.SYNC_SEND_RECEIVE}
+	config = c.Config{Shares: []c.Share{share}}.ForShare(share)
+	if err := os.WriteFile(filepath.Join(testdir, "sent.txt"), []byte("local edit"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	changedFiles[share.ID] = []FileChange{{File: "sent.txt", Change: FILE_MOD}}
+	shipFileChanges(config)
+	if entry := GetIndexedFileInfo(share.ID, "sent.txt"); entry == nil || entry.LocalChange || entry.Version.IsEmpty() {
+		t.Errorf("local change wasn't versioned: %+v", entry)
+	}
+
+	// remote changes are checked against the mode of the peer that sent them
+	share.Mode = c.SYNC_SEND_RECEIVE
+	share.PeerModes = map[string]string{"laptop": c.SYNC_SEND_ONLY}
+	config = c.Config{Shares: []c.Share{share}}.ForShare(share)
+	HandleRemoteFileChange(m.NotifyFileChange{
+		File:    "sent.txt",
+		Change:  FILE_DEL,
+		Version: GetFileVersion(share.ID, "sent.txt").Merge(m.VersionVector{"laptop": 1}),
+	}, m.Peer{ID: "laptop", IP: "10.0.0.5"}, config)
+	if _, err := os.Stat(filepath.Join(testdir, "sent.txt")); err != nil {
+		t.Error("share applied a remote deletion from a peer it's send-only with:", err)
+	}
+}
+
+// indexes every file in a test directory, like ScanLocalChanges does when a node starts, but without recording any changes
+func indexTestDir(shareID string, dir string) {
+	err := util.Walk(dir, dir, walkLinkMode(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || ignoreFile(path) {
+			return nil
+		}
+		_, err = indexFile(shareID, util.RemovePathPrefix(path, dir), path, info)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to index %s: %s", dir, err)
+	}
+}
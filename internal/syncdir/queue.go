@@ -0,0 +1,239 @@
+package syncdir
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// at most this many remote changes wait in the queue. changes that don't fit are dropped; they're picked up again the next time we reconcile with the peer.
+const maxQueuedChanges = 10000
+
+// a remote change waiting to be applied, or being applied
+type transferJob struct {
+	change   m.NotifyFileChange
+	peer     m.Peer   // the peer the change came from
+	config   c.Config // scoped to the share the file is in
+	pinned   bool
+	queuedAt time.Time
+	seq      uint64 // order the job was queued in, for breaking ties
+}
+
+// the state of a remote change in the transfer queue
+type TransferStatus struct {
+	Share    string // ID of the share the file is in
+	File     string
+	Change   string
+	Size     int64
+	Peer     string // ID of the peer the change came from
+	Pinned   bool   // whether the file is under one of the pinned paths, so it's transferred before other files
+	Active   bool   // whether the change is being applied right now, as opposed to waiting its turn
+	QueuedAt time.Time
+}
+
+var (
+	queuedJobs   map[string][]transferJob = map[string][]transferJob{} // remote changes waiting to be applied, by share and file (see jobKey), in the order they were queued
+	activeJobs   map[string]transferJob   = map[string]transferJob{}   // remote changes being applied right now, by share and file
+	queuedCount  int                                                   // how many changes are waiting, across all files
+	jobSeq       uint64
+	queueMutex   sync.Mutex
+	queueCond    *sync.Cond = sync.NewCond(&queueMutex)
+	startWorkers sync.Once
+)
+
+// queues a file change notification from a peer, to be applied once it's its turn. takes a config scoped to the share the file is in.
+//
+// a few changes are applied at the same time. files under the pinned paths go first, and then the smallest files.
+// if a change to the same file is already waiting, only the newer of the two is kept. concurrent changes are both kept,
+// and applied one after the other, so that the second one still ends up as a conflict.
+func QueueRemoteFileChange(fileChange m.NotifyFileChange, p m.Peer, config c.Config) {
+	startWorkers.Do(func() {
+		for i := 0; i < config.GetMaxConcurrentTransfers(); i++ {
+			go transferWorker()
+		}
+	})
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	key := jobKey(config.ShareID, fileChange.File)
+	kept := []transferJob{}
+	for _, queued := range queuedJobs[key] {
+		switch queued.change.Version.Compare(fileChange.Version) {
+		case m.VERSION_NEWER, m.VERSION_EQUAL:
+			return // already have this change to the file queued up, or a newer one
+		case m.VERSION_CONCURRENT:
+			kept = append(kept, queued)
+		}
+	}
+	replaced := len(queuedJobs[key]) - len(kept)
+	if replaced == 0 && queuedCount >= maxQueuedChanges {
+		log.Println("transfer queue is full; dropping remote change:", fileChange)
+		return
+	}
+	jobSeq++
+	queuedJobs[key] = append(kept, transferJob{
+		change:   fileChange,
+		peer:     p,
+		config:   config,
+		pinned:   isPinned(fileChange.File, config),
+		queuedAt: time.Now(),
+		seq:      jobSeq,
+	})
+	queuedCount += 1 - replaced
+	queueCond.Signal()
+}
+
+// gets the state of every remote change that is waiting or being applied
+func GetTransferQueue() []TransferStatus {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	statuses := make([]TransferStatus, 0, len(activeJobs)+queuedCount)
+	for _, job := range activeJobs {
+		statuses = append(statuses, job.status(true))
+	}
+	for _, jobs := range queuedJobs {
+		for _, job := range jobs {
+			statuses = append(statuses, job.status(false))
+		}
+	}
+	return statuses
+}
+
+func (job transferJob) status(active bool) TransferStatus {
+	return TransferStatus{
+		Share:    job.config.ShareID,
+		File:     job.change.File,
+		Change:   job.change.Change,
+		Size:     job.change.Size,
+		Peer:     job.peer.ID,
+		Pinned:   job.pinned,
+		Active:   active,
+		QueuedAt: job.queuedAt,
+	}
+}
+
+// identifies the file a job changes, since files in different shares can have the same name
+func jobKey(shareID string, filename string) string {
+	return shareID + "/" + filename
+}
+
+// applies queued remote changes, one at a time, forever
+func transferWorker() {
+	for {
+		job := nextJob()
+		HandleRemoteFileChange(job.change, job.peer, job.config)
+
+		queueMutex.Lock()
+		delete(activeJobs, jobKey(job.config.ShareID, job.change.File))
+		queueMutex.Unlock()
+		// a change to the same file may have been waiting for this one to finish
+		queueCond.Broadcast()
+	}
+}
+
+// waits for the highest priority job that can be started, and marks it as active
+func nextJob() transferJob {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	for {
+		var next *transferJob
+		for key, jobs := range queuedJobs {
+			// changes to the same file are applied one after another, in the order they were queued, never at the same time
+			if _, active := activeJobs[key]; active {
+				continue
+			}
+			if job := jobs[0]; next == nil || job.before(*next) {
+				next = &job
+			}
+		}
+		if next != nil {
+			key := jobKey(next.config.ShareID, next.change.File)
+			if jobs := queuedJobs[key][1:]; len(jobs) > 0 {
+				queuedJobs[key] = jobs
+			} else {
+				delete(queuedJobs, key)
+			}
+			queuedCount--
+			activeJobs[key] = *next
+			return *next
+		}
+		queueCond.Wait()
+	}
+}
+
+// whether a job should be started before another one
+func (job transferJob) before(other transferJob) bool {
+	if job.pinned != other.pinned {
+		return job.pinned
+	}
+	if job.change.Size != other.change.Size {
+		return job.change.Size < other.change.Size
+	}
+	return job.seq < other.seq
+}
+
+// whether a file is one of the pinned paths, or somewhere under one
+func isPinned(filename string, config c.Config) bool {
+	for _, pinned := range config.PinnedPaths {
+		pinned = strings.Trim(pinned, string(os.PathSeparator))
+		if filename == pinned || strings.HasPrefix(filename, pinned+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	applyingPaths      map[string]int = map[string]int{} // paths that remote changes are being applied to, and how many
+	applyingPathsMutex sync.Mutex
+)
+
+// marks the full paths a remote change is being applied to, so the file events the change causes aren't mistaken for local changes.
+// returns a function to call once the change has been applied.
+func applyingRemoteChange(paths ...string) func() {
+	applyingPathsMutex.Lock()
+	defer applyingPathsMutex.Unlock()
+
+	for _, path := range paths {
+		if path != "" {
+			applyingPaths[path]++
+		}
+	}
+	return func() {
+		// file events arrive a little after the change that caused them
+		time.AfterFunc(time.Second, func() {
+			applyingPathsMutex.Lock()
+			defer applyingPathsMutex.Unlock()
+
+			for _, path := range paths {
+				if path == "" {
+					continue
+				}
+				if applyingPaths[path]--; applyingPaths[path] <= 0 {
+					delete(applyingPaths, path)
+				}
+			}
+		})
+	}
+}
+
+// whether a remote change is being applied to a file, or to a directory it's in
+func isApplyingRemoteChange(filename string) bool {
+	applyingPathsMutex.Lock()
+	defer applyingPathsMutex.Unlock()
+
+	for path := range applyingPaths {
+		if filename == path || strings.HasPrefix(filename, path+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package syncdir
+
+import (
+	"testing"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+func TestTransferJobOrder(t *testing.T) {
+	config := c.Config{PinnedPaths: []string{"docs/"}}
+	job := func(file string, size int64, seq uint64) transferJob {
+		return transferJob{
+			change: m.NotifyFileChange{File: file, Size: size},
+			pinned: isPinned(file, config),
+			seq:    seq,
+		}
+	}
+	testCases := []struct {
+		name        string
+		first, then transferJob
+	}{
+		{"pinned before small", job("docs/big.pdf", 1<<30, 2), job("small.txt", 10, 1)},
+		{"small before big", job("small.txt", 10, 2), job("big.iso", 1<<30, 1)},
+		{"earlier before later", job("a.txt", 10, 1), job("b.txt", 10, 2)},
+	}
+	for _, tc := range testCases {
+		if !tc.first.before(tc.then) || tc.then.before(tc.first) {
+			t.Errorf("%s: %s should be transferred before %s", tc.name, tc.first.change.File, tc.then.change.File)
+		}
+	}
+	if isPinned("docsfile.txt", config) {
+		t.Error("docsfile.txt is not under pinned path docs/")
+	}
+}
+
+func TestQueueConcurrentChanges(t *testing.T) {
+	// keep the workers from applying the test's changes
+	startWorkers.Do(func() {})
+	config := c.Config{ShareID: "queue"}
+	queue := func(version m.VersionVector) {
+		QueueRemoteFileChange(m.NotifyFileChange{File: "a.txt", Change: FILE_MOD, Version: version}, m.Peer{ID: "laptop", IP: "10.0.0.2"}, config)
+	}
+
+	queue(m.VersionVector{"laptop": 1})
+	queue(m.VersionVector{"laptop": 2}) // replaces the older change
+	queue(m.VersionVector{"laptop": 1, "desktop": 1})
+	queue(m.VersionVector{"laptop": 2}) // already queued
+	jobs := queuedJobs[jobKey("queue", "a.txt")]
+	if len(jobs) != 2 || jobs[0].change.Version["laptop"] != 2 || jobs[1].change.Version["desktop"] != 1 {
+		t.Errorf("expected both concurrent changes to be queued; got %v", jobs)
+		return
+	}
+	if queue := GetTransferQueue(); len(queue) != 2 {
+		t.Errorf("expected 2 changes in the transfer queue; got %v", queue)
+	}
+
+	// they're applied one after the other, in the order they were queued
+	first := nextJob()
+	if first.change.Version["laptop"] != 2 || first.change.Version["desktop"] != 0 {
+		t.Error("unexpected first change:", first.change.Version)
+	}
+	queueMutex.Lock()
+	delete(activeJobs, jobKey("queue", "a.txt"))
+	queueMutex.Unlock()
+	if second := nextJob(); second.change.Version["desktop"] != 1 {
+		t.Error("unexpected second change:", second.change.Version)
+	}
+	queueMutex.Lock()
+	delete(activeJobs, jobKey("queue", "a.txt"))
+	queueMutex.Unlock()
+	if len(queuedJobs) != 0 || queuedCount != 0 {
+		t.Errorf("expected the queue to be empty; got %v (%v)", queuedJobs, queuedCount)
+	}
+}
+
+func TestApplyingRemoteChange(t *testing.T) {
+	done := applyingRemoteChange("dir/sub", "")
+	if !isApplyingRemoteChange("dir/sub") || !isApplyingRemoteChange("dir/sub/file.txt") {
+		t.Error("paths under a remote change should be marked as applying")
+	}
+	if isApplyingRemoteChange("dir") || isApplyingRemoteChange("dir/subfile.txt") {
+		t.Error("paths outside a remote change shouldn't be marked as applying")
+	}
+	done()
+}
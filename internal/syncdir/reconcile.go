@@ -0,0 +1,219 @@
+package syncdir
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	messagebroker "github.com/webbben/p2p-file-share/internal/message-broker"
+	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+var (
+	reconciling      map[string]bool = map[string]bool{} // the peers and shares currently being reconciled, as peer key + share ID
+	reconcilingMutex sync.Mutex
+)
+
+// finds changes that were made to the shared directory while this node wasn't running, and records them as local changes.
+// they are shared with peers when reconciling with them.
+func ScanLocalChanges(config c.Config) {
+	dir := config.SharedDirectoryPath
+	if dir == "" {
+		log.Println("failed to scan for local changes: no directory specified.")
+		return
+	}
+	// changes to a share that's receive-only with every peer are only flagged, never versioned
+	recordChange := func(filename string, isDir bool, deleted bool) {
+		if !config.SendsChanges() {
+			markLocalChange(config.ShareID, filename, isDir)
+			return
+		}
+		bumpFileVersion(config.ShareID, filename, config.NodeID(), isDir, deleted)
+	}
+	entries := getIndexEntries(config.ShareID)
+	onDisk := map[string]bool{}
+	err := util.Walk(dir, dir, walkLinkMode(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || ignoreFile(path) {
+			return nil
+		}
+		filename := util.RemovePathPrefix(path, dir)
+		onDisk[filename] = true
+		entry, err := indexFile(config.ShareID, filename, path, info)
+		if err != nil {
+			return err
+		}
+		previous, exists := entries[filename]
+		if !exists || previous.Deleted || previous.Version.IsEmpty() {
+			fmt.Println("found new file:", filename)
+			recordChange(filename, info.IsDir(), false)
+		} else if entry.Hash != previous.Hash {
+			fmt.Println("found modified file:", filename)
+			recordChange(filename, false, false)
+		} else if entry.Mode.Perm() != previous.Mode.Perm() {
+			fmt.Println("found file with changed permissions:", filename)
+			recordChange(filename, info.IsDir(), false)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("failed to scan for local changes:", err)
+		return
+	}
+	for filename, entry := range entries {
+		if !entry.Deleted && !onDisk[filename] {
+			fmt.Println("found deleted file:", filename)
+			recordChange(filename, entry.IsDir, true)
+		}
+	}
+}
+
+// exchanges file summaries of a share with a peer, and pulls or pushes whatever changes are needed for both copies of the share to converge.
+//
+// changes the peer has that we don't are queued up just like a file change notification from that peer.
+// changes we have that the peer doesn't are sent to the peer as file change notifications, so it can pull them from us.
+func ReconcileWithPeer(p m.Peer, config c.Config) {
+	if !config.IsShareMember(p.ID) {
+		return
+	}
+	// don't reconcile the same share with the same peer more than once at a time
+	key := p.Key() + "/" + config.ShareID
+	reconcilingMutex.Lock()
+	if reconciling[key] {
+		reconcilingMutex.Unlock()
+		return
+	}
+	reconciling[key] = true
+	reconcilingMutex.Unlock()
+	defer func() {
+		reconcilingMutex.Lock()
+		delete(reconciling, key)
+		reconcilingMutex.Unlock()
+	}()
+
+	remoteFiles, err := messagebroker.ScanFiles(p, config.ShareID)
+	if err != nil {
+		log.Printf("failed to reconcile share %s with peer %s: %s\n", config.ShareID, p.IP, err)
+		return
+	}
+	fmt.Printf("reconciling %v files of share %s with peer %s (%s)\n", len(remoteFiles), config.ShareID, p.Nickname, p.IP)
+
+	// changes only flow the ways the share's sync mode with the peer allows
+	mode := config.GetSyncMode(p.ID)
+	send, receive := mode != c.SYNC_RECEIVE_ONLY, mode != c.SYNC_SEND_ONLY
+	localEntries := getIndexEntries(config.ShareID)
+	for _, remoteFile := range remoteFiles {
+		localEntry, exists := localEntries[remoteFile.Name]
+		delete(localEntries, remoteFile.Name)
+
+		if remoteFile.Deleted && (!exists || localEntry.Deleted) {
+			// the file is gone on both sides, so there's nothing to transfer; only the tombstones need to agree.
+			// a missing local entry means the tombstone was already forgotten here, or the file was never seen.
+			if exists && receive {
+				if comparison := remoteFile.Version.Compare(localEntry.Version); comparison == m.VERSION_NEWER || comparison == m.VERSION_CONCURRENT {
+					recordDeletion(config.ShareID, remoteFile.Name, localEntry.Version.Merge(remoteFile.Version), remoteFile.IsDir, remoteFile.DeletedBy, remoteFile.DeletedAt)
+				}
+			}
+			acknowledgeTombstone(config.ShareID, remoteFile.Name, p.Key(), remoteFile.Version)
+			continue
+		}
+		switch remoteFile.Version.Compare(localEntry.Version) {
+		case m.VERSION_NEWER, m.VERSION_CONCURRENT:
+			if !receive {
+				break // never take changes from this peer
+			}
+			QueueRemoteFileChange(fileChangeNotification(remoteFile.Name, IndexEntry{
+				Hash:      remoteFile.Checksum,
+				Mode:      remoteFile.Mode,
+				Size:      remoteFile.Size,
+				IsDir:     remoteFile.IsDir,
+				Version:   remoteFile.Version,
+				Deleted:   remoteFile.Deleted,
+				DeletedBy: remoteFile.DeletedBy,
+				DeletedAt: remoteFile.DeletedAt,
+
+				LinkTarget: remoteFile.LinkTarget,
+			}, config.ShareID), p, config)
+		case m.VERSION_OLDER:
+			if send {
+				pushFileChange(p, remoteFile.Name, localEntry, config.ShareID)
+			}
+		}
+	}
+	// whatever is left, the peer doesn't know about at all
+	for filename, localEntry := range localEntries {
+		if localEntry.Deleted {
+			// the peer never had the file, or already forgot its tombstone, so it has nothing to bring back
+			acknowledgeTombstone(config.ShareID, filename, p.Key(), localEntry.Version)
+			continue
+		}
+		if !send || localEntry.Version.IsEmpty() {
+			continue // not sent to this peer, or not shared yet
+		}
+		pushFileChange(p, filename, localEntry, config.ShareID)
+	}
+	collectTombstones(config)
+	fmt.Printf("finished reconciling with peer %s (%s)\n", p.Nickname, p.IP)
+}
+
+// gets a summary of all the files in a share this node knows of, including deleted ones
+func GetFileSummary(shareID string) m.NodeFileSummary {
+	summary := m.NodeFileSummary{
+		Type:  c.TYPE_SCAN_FILES,
+		Share: shareID,
+		Files: []m.FileInfo{},
+	}
+	for filename, entry := range getIndexEntries(shareID) {
+		if entry.Version.IsEmpty() {
+			continue // not shared yet
+		}
+		summary.Files = append(summary.Files, m.FileInfo{
+			Name:     filename,
+			Checksum: entry.Hash,
+			Mode:     entry.Mode,
+			Size:     entry.Size,
+			IsDir:    entry.IsDir,
+			Deleted:  entry.Deleted,
+			Version:  entry.Version,
+
+			DeletedBy: entry.DeletedBy,
+			DeletedAt: entry.DeletedAt,
+
+			LinkTarget: entry.LinkTarget,
+		})
+	}
+	return summary
+}
+
+func pushFileChange(p m.Peer, filename string, entry IndexEntry, shareID string) {
+	if err := messagebroker.SendMessage(p, fileChangeNotification(filename, entry, shareID)); err != nil {
+		log.Printf("failed to push %s to peer %s: %s\n", filename, p.IP, err)
+	}
+}
+
+func fileChangeNotification(filename string, entry IndexEntry, shareID string) m.NotifyFileChange {
+	notification := m.NotifyFileChange{
+		Type:     c.TYPE_FILE_CHANGE_NOTIFY,
+		Share:    shareID,
+		File:     filename,
+		IsDir:    entry.IsDir,
+		Change:   FILE_MOD,
+		Version:  entry.Version,
+		Checksum: entry.Hash,
+		Mode:     entry.Mode,
+		Size:     entry.Size,
+
+		LinkTarget: entry.LinkTarget,
+	}
+	if entry.Deleted {
+		notification.Change = FILE_DEL
+		notification.Node = entry.DeletedBy
+		notification.Time = entry.DeletedAt
+	}
+	return notification
+}
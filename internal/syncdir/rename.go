@@ -0,0 +1,194 @@
+package syncdir
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+// stands in for the hash of a directory when matching moved directories
+const dirHash string = "dir"
+
+// finds files that disappeared from one path and showed up at another in the same batch of changes, and turns each pair into a single rename.
+// a file counts as moved if its contents are the same; a directory counts as moved if every file inside it shows up under the new path.
+func pairRenames(changes []FileChange, config c.Config) []FileChange {
+	// hash the new files, so they can be compared to the files that disappeared
+	hashes := map[string]string{}
+	for _, change := range changes {
+		if change.Change != FILE_MOD {
+			continue
+		}
+		if change.IsDir {
+			hashes[change.File] = dirHash
+			continue
+		}
+		entry, err := indexFile(config.ShareID, change.File, getFullFilePath(change.File, config), nil)
+		if err != nil {
+			continue
+		}
+		hashes[change.File] = entry.Hash
+	}
+	if len(hashes) == 0 {
+		return changes
+	}
+
+	paired := map[string]bool{} // files of the changes that were turned into renames
+	renames := []FileChange{}
+	for _, change := range changes {
+		if change.Change != FILE_DEL {
+			continue
+		}
+		oldEntry := GetIndexedFileInfo(config.ShareID, change.File)
+		if oldEntry == nil || oldEntry.Deleted {
+			continue
+		}
+		var newFile string
+		var moved []string
+		if oldEntry.IsDir {
+			newFile, moved = matchMovedDirectory(config.ShareID, change.File, hashes, paired)
+		} else {
+			newFile = matchMovedFile(change.File, oldEntry.Hash, hashes, paired)
+			moved = []string{newFile}
+		}
+		if newFile == "" {
+			continue
+		}
+		fmt.Printf("detected rename: %s -> %s\n", change.File, newFile)
+		paired[change.File] = true
+		for _, file := range moved {
+			paired[file] = true
+		}
+		renames = append(renames, FileChange{
+			File:     newFile,
+			FullPath: getFullFilePath(newFile, config),
+			Change:   FILE_RENAME,
+			IsDir:    oldEntry.IsDir,
+			OldFile:  change.File,
+		})
+	}
+
+	output := make([]FileChange, 0, len(changes))
+	for _, change := range changes {
+		if !paired[change.File] {
+			output = append(output, change)
+		}
+	}
+	return append(output, renames...)
+}
+
+// finds a new file with the same contents as a file that disappeared
+func matchMovedFile(oldFile string, hash string, hashes map[string]string, paired map[string]bool) string {
+	if hash == "" || hash == dirHash {
+		return ""
+	}
+	for file, newHash := range hashes {
+		if newHash == hash && file != oldFile && !paired[file] {
+			return file
+		}
+	}
+	return ""
+}
+
+// finds a new directory containing exactly the files and sub-directories that were in a directory that disappeared.
+// returns the new directory, and the new paths of the directory and everything inside it.
+func matchMovedDirectory(shareID string, oldDir string, hashes map[string]string, paired map[string]bool) (string, []string) {
+	prefix := oldDir + string(os.PathSeparator)
+	nested := map[string]string{} // path relative to the directory -> hash
+	for filename, entry := range getIndexEntries(shareID) {
+		if !strings.HasPrefix(filename, prefix) || entry.Deleted {
+			continue
+		}
+		if entry.IsDir {
+			nested[strings.TrimPrefix(filename, prefix)] = dirHash
+		} else {
+			nested[strings.TrimPrefix(filename, prefix)] = entry.Hash
+		}
+	}
+	for file, hash := range hashes {
+		if hash != dirHash || file == oldDir || paired[file] {
+			continue
+		}
+		// an empty directory can only be matched by its name
+		if len(nested) == 0 && filepath.Base(file) != filepath.Base(oldDir) {
+			continue
+		}
+		if moved := matchDirectoryContents(file, nested, hashes, paired); moved != nil {
+			return file, append(moved, file)
+		}
+	}
+	return "", nil
+}
+
+// checks whether the new files under newDir are exactly the expected files. returns their paths if so.
+func matchDirectoryContents(newDir string, expected map[string]string, hashes map[string]string, paired map[string]bool) []string {
+	prefix := newDir + string(os.PathSeparator)
+	moved := []string{}
+	for file, hash := range hashes {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		if paired[file] || expected[strings.TrimPrefix(file, prefix)] != hash {
+			return nil
+		}
+		moved = append(moved, file)
+	}
+	if len(moved) != len(expected) {
+		return nil
+	}
+	return moved
+}
+
+// applies a rename from a peer by renaming our own copy, so nothing needs to be transferred.
+// if our copy isn't the same as the one the peer renamed, the new file is requested and the old one deleted instead.
+func applyRemoteRename(fileChange m.NotifyFileChange, localVersion m.VersionVector, p m.Peer, config c.Config) {
+	oldPath := getFullFilePath(fileChange.OldFile, config)
+	newPath := getFullFilePath(fileChange.File, config)
+	if fileChange.OldFile == "" || oldPath == "" || newPath == "" {
+		log.Println("failed to apply rename; missing file paths")
+		return
+	}
+	oldEntry := GetIndexedFileInfo(config.ShareID, fileChange.OldFile)
+	sameFile := oldEntry != nil && !oldEntry.Deleted && oldEntry.IsDir == fileChange.IsDir && (fileChange.IsDir || oldEntry.Hash == fileChange.Checksum)
+	if sameFile {
+		err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
+		if err == nil {
+			err = os.Rename(oldPath, newPath)
+		}
+		if err == nil {
+			renameIndexEntry(config.ShareID, fileChange.OldFile, fileChange.File, fileChange.Node, fileChange.Time)
+			setFileVersion(config.ShareID, fileChange.File, GetFileVersion(config.ShareID, fileChange.File).Merge(fileChange.Version), fileChange.IsDir)
+			recordDeletion(config.ShareID, fileChange.OldFile, GetFileVersion(config.ShareID, fileChange.OldFile).Merge(fileChange.OldVersion), fileChange.IsDir, fileChange.Node, fileChange.Time)
+			fmt.Printf("renamed %s -> %s\n", fileChange.OldFile, fileChange.File)
+			return
+		}
+		log.Println("failed to rename file:", err)
+	}
+
+	if fileChange.IsDir {
+		// we don't know what the peer's directory contains, so catch up on everything
+		log.Printf("can't apply rename of directory %s locally; reconciling with peer instead\n", fileChange.OldFile)
+		go ReconcileWithPeer(p, config)
+		return
+	}
+	fmt.Printf("can't apply rename of %s locally; requesting %s instead\n", fileChange.OldFile, fileChange.File)
+	modification := fileChange
+	modification.Change = FILE_MOD
+	applyRemoteModification(modification, localVersion, p, config)
+
+	oldLocalVersion := GetFileVersion(config.ShareID, fileChange.OldFile)
+	if fileChange.OldVersion.Compare(oldLocalVersion) == m.VERSION_NEWER {
+		applyRemoteDeletion(m.NotifyFileChange{
+			Type:    c.TYPE_FILE_CHANGE_NOTIFY,
+			File:    fileChange.OldFile,
+			Change:  FILE_DEL,
+			Version: fileChange.OldVersion,
+			Node:    fileChange.Node,
+			Time:    fileChange.Time,
+		}, oldLocalVersion, config)
+	}
+}
@@ -0,0 +1,91 @@
+package syncdir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+func TestPairRenames(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testrename")
+	if err := util.EnsureDir(filepath.Join(testdir, "olddir", "x")); err != nil {
+		t.Error("failed to create test directory:", err)
+		return
+	}
+	defer os.RemoveAll(testdir)
+	config := c.Config{SharedDirectoryPath: testdir, ShareID: c.DEFAULT_SHARE_ID}
+
+	files := map[string]string{
+		"a.txt":                               "a",
+		filepath.Join("olddir", "b.txt"):      "b",
+		filepath.Join("olddir", "x", "c.txt"): "c",
+	}
+	for file, contents := range files {
+		if err := os.WriteFile(filepath.Join(testdir, file), []byte(contents), 0644); err != nil {
+			t.Error("failed to write test file:", err)
+			return
+		}
+	}
+	indexTestDir(c.DEFAULT_SHARE_ID, testdir)
+
+	// move a file and a directory
+	if err := os.Rename(filepath.Join(testdir, "a.txt"), filepath.Join(testdir, "moved.txt")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.Rename(filepath.Join(testdir, "olddir"), filepath.Join(testdir, "newdir")); err != nil {
+		t.Error(err)
+		return
+	}
+	changes := pairRenames([]FileChange{
+		{File: "a.txt", Change: FILE_DEL},
+		{File: "moved.txt", Change: FILE_MOD},
+		{File: "olddir", Change: FILE_DEL, IsDir: true},
+		{File: "newdir", Change: FILE_MOD, IsDir: true},
+		{File: filepath.Join("newdir", "x"), Change: FILE_MOD, IsDir: true},
+		{File: filepath.Join("newdir", "b.txt"), Change: FILE_MOD},
+		{File: filepath.Join("newdir", "x", "c.txt"), Change: FILE_MOD},
+	}, config)
+
+	exp := []FileChange{
+		{File: "moved.txt", OldFile: "a.txt", Change: FILE_RENAME},
+		{File: "newdir", OldFile: "olddir", Change: FILE_RENAME, IsDir: true},
+	}
+	if len(changes) != len(exp) {
+		t.Errorf("incorrect number of changes. exp: %v, got: %v", exp, changes)
+		return
+	}
+	for _, expChange := range exp {
+		found := false
+		for _, change := range changes {
+			if expChange.IsSame(change) && expChange.OldFile == change.OldFile {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing file change: %v (%s)", expChange, expChange.OldFile)
+		}
+	}
+
+	// renaming moves the index entries along with their versions
+	_, version := renameIndexEntry(c.DEFAULT_SHARE_ID, "olddir", "newdir", "node", time.Now())
+	if version["node"] != 1 {
+		t.Error("unexpected version of renamed directory:", version)
+	}
+	if entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filepath.Join("newdir", "x", "c.txt")); entry == nil || entry.Deleted || entry.Hash == "" {
+		t.Errorf("nested file wasn't moved in the index: %+v", entry)
+	}
+	if entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filepath.Join("olddir", "x", "c.txt")); entry == nil || !entry.Deleted {
+		t.Errorf("old path of nested file should be deleted: %+v", entry)
+	}
+}
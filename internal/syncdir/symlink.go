@@ -0,0 +1,86 @@
+package syncdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/util"
+)
+
+// how symbolic links in the shared directories are handled; see the SYMLINK_* policies in config.
+// set once at startup with UseSymlinkPolicy, before any share is scanned or watched.
+var symlinkPolicy string = c.SYMLINK_LINK
+
+// sets how symbolic links in the shared directories are handled
+func UseSymlinkPolicy(policy string) {
+	symlinkPolicy = policy
+}
+
+// how util.Walk should handle symbolic links under the symlink policy
+func walkLinkMode() util.LinkMode {
+	switch symlinkPolicy {
+	case c.SYMLINK_FOLLOW:
+		return util.LINKS_FOLLOW
+	case c.SYMLINK_IGNORE:
+		return util.LINKS_SKIP
+	}
+	return util.LINKS_AS_LINKS
+}
+
+// stats a file in the shared directory. symbolic links are only followed if the symlink policy says to.
+func statFile(fullPath string) (os.FileInfo, error) {
+	if symlinkPolicy == c.SYMLINK_FOLLOW {
+		return os.Stat(fullPath)
+	}
+	return os.Lstat(fullPath)
+}
+
+// whether a file should be synced under the symlink policy. anything that isn't a symbolic link always is.
+func symlinkAllowed(dir string, fullPath string) bool {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return true
+	}
+	switch symlinkPolicy {
+	case c.SYMLINK_LINK:
+		return util.LinkStaysInRoot(dir, fullPath)
+	case c.SYMLINK_FOLLOW:
+		target, err := filepath.EvalSymlinks(fullPath)
+		return err == nil && util.IsInsideDirectory(dir, target)
+	}
+	return false
+}
+
+// stands in for the hash of a symbolic link's contents, so links can be compared like files
+func hashLinkTarget(target string) string {
+	hash := sha256.Sum256([]byte("symlink:" + target))
+	return hex.EncodeToString(hash[:])
+}
+
+// creates a symbolic link that a peer synced as a link, replacing whatever is at its path
+func createLink(fileChange m.NotifyFileChange, config c.Config) error {
+	linkPath := getFullFilePath(fileChange.File, config)
+	if linkPath == "" {
+		return errors.New("no filepath provided")
+	}
+	if !util.LinkTargetStaysInRoot(config.SharedDirectoryPath, linkPath, fileChange.LinkTarget) {
+		return fmt.Errorf("link %s points outside the shared directory (%s)", fileChange.File, fileChange.LinkTarget)
+	}
+	if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Remove(linkPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Symlink(fileChange.LinkTarget, linkPath); err != nil {
+		return err
+	}
+	_, err := indexFile(config.ShareID, fileChange.File, linkPath, nil)
+	return err
+}
@@ -2,11 +2,13 @@ package syncdir
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -14,6 +16,7 @@ import (
 	filetransfer "github.com/webbben/p2p-file-share/internal/file-transfer"
 	messagebroker "github.com/webbben/p2p-file-share/internal/message-broker"
 	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/state"
 	"github.com/webbben/p2p-file-share/internal/util"
 )
 
@@ -22,6 +25,7 @@ type FileChange struct {
 	FullPath string // full path of the file that was changed
 	Change   string
 	IsDir    bool
+	OldFile  string // for renames, the previous path of the file
 }
 
 func (fc FileChange) String() string {
@@ -33,38 +37,31 @@ func (fc FileChange) IsSame(c FileChange) bool {
 }
 
 const (
-	FILE_MOD string = "mod" // file modified (or created) - signals a file should be copied over to other nodes
-	FILE_DEL string = "del" // file deleted - signals a file should be deleted from other nodes
+	FILE_MOD    string = "mod"    // file modified (or created) - signals a file should be copied over to other nodes
+	FILE_DEL    string = "del"    // file deleted - signals a file should be deleted from other nodes
+	FILE_RENAME string = "rename" // file renamed or moved - signals other nodes can rename their own copy, rather than transferring it again
+	FILE_META   string = "meta"   // file permissions changed - signals other nodes can update their own copy, rather than transferring it again
 )
 
 var (
-	changeFlag            bool         = false          // flag for when changes have been detected
-	changedFiles          []FileChange = []FileChange{} // file changes queued up to be broadcast
-	applyingRemoteChanges bool         = false          // flag for when remote changes are being applied
+	changeFlag   map[string]bool         = map[string]bool{}         // flag for when changes have been detected, by share
+	changedFiles map[string][]FileChange = map[string][]FileChange{} // file changes queued up to be broadcast, by share
+	changesMutex sync.Mutex
 
-	fileIndex map[string]os.FileInfo // index of all files and their info
+	lastReported      map[string]reportedFile = map[string]reportedFile{} // the last file reported as changed, by share
+	lastReportedMutex sync.Mutex
 )
 
-func GetIndexedFileInfo(filename string) os.FileInfo {
-	fileInfo, exists := fileIndex[filename]
-	if !exists {
-		log.Println("file is not indexed:", filename)
-		return nil
-	}
-	return fileInfo
+type reportedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
 }
 
-func RefreshFileIndex(dir string) {
-	index, err := util.IndexDirectory(dir)
-	if err != nil {
-		log.Printf("failed to index %s: %s", dir, err)
-		return
-	}
-	fileIndex = index
-}
-
-// start watching for file changes in the shared file directory, so changes can be communicated to other nodes
-func WatchForFileChanges(dir string) {
+// start watching for file changes in the shared file directory of a share, so changes can be communicated to other nodes.
+// takes a config scoped to the share (see config.ForShare).
+func WatchForFileChanges(config c.Config) {
+	dir := config.SharedDirectoryPath
 	if dir == "" {
 		log.Println("Failed to watch for file changes: no directory specified.")
 		return
@@ -75,13 +72,12 @@ func WatchForFileChanges(dir string) {
 	}
 	defer watcher.Close()
 
-	RefreshFileIndex(dir)
-
-	// watch for file events
+	// watch for file events.
+	// the share was indexed when the node started (see ScanLocalChanges), so from here on only the paths that change are indexed
 	for {
-		fileChanges, restart := awaitNextFileChange(watcher, dir)
+		fileChanges, restart := awaitNextFileChange(watcher, dir, config.ShareID)
 		for _, change := range fileChanges {
-			queueFileChange(change)
+			queueFileChange(change, config)
 		}
 		if restart {
 			break
@@ -90,7 +86,7 @@ func WatchForFileChanges(dir string) {
 	// if an error occurs with fsnotify, try waiting a few seconds before restarting
 	fmt.Println("Restarting file watcher in a second...")
 	time.Sleep(1 * time.Second)
-	go WatchForFileChanges(dir)
+	go WatchForFileChanges(config)
 }
 
 // makes a watcher that watches for file changes in the given directory and all sub-directories
@@ -106,7 +102,7 @@ func getWatcher(dir string) (*fsnotify.Watcher, error) {
 	}
 
 	// recursively add all sub-directories to the watcher too
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	err = util.Walk(dir, dir, walkLinkMode(), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -128,27 +124,22 @@ func getWatcher(dir string) (*fsnotify.Watcher, error) {
 // return the next filechange
 //
 // returns: FileChange, whether to restart filewatcher (e.g. if an error happens and we want to restart)
-func awaitNextFileChange(watcher *fsnotify.Watcher, dir string) ([]FileChange, bool) {
-	refreshIndex := false
-	defer func() {
-		if refreshIndex {
-			RefreshFileIndex(dir)
-		}
-	}()
-
+func awaitNextFileChange(watcher *fsnotify.Watcher, dir string, shareID string) ([]FileChange, bool) {
 	select {
 	case event, ok := <-watcher.Events:
 		if !ok {
 			log.Println("WARNING: file change watcher closed unexpectedly!")
 			return nil, true
 		}
-		// ignore if these changes are just being transferred from other nodes
-		if applyingRemoteChanges {
-			fmt.Println("remote change: ignore file event")
+		if ignoreFile(event.Name) || !symlinkAllowed(dir, event.Name) {
 			return nil, false
 		}
-		if ignoreFile(event.Name) {
-			return nil, false
+		// ignore if these changes are just being transferred from other nodes
+		if isApplyingRemoteChange(event.Name) {
+			fmt.Println("remote change: ignore file event")
+			// directories created by other nodes still need to be watched
+			isDir, _ := util.IsDirectory(event.Name)
+			return nil, event.Op&fsnotify.Create == fsnotify.Create && isDir
 		}
 		fmt.Println("raw filename:", event.Name)
 		fileChange := FileChange{
@@ -166,45 +157,82 @@ func awaitNextFileChange(watcher *fsnotify.Watcher, dir string) ([]FileChange, b
 		} else if event.Op&fsnotify.Remove == fsnotify.Remove {
 			log.Printf("Removed %s (%s)\n", event.Name, event.Op)
 			fileChange.Change = FILE_DEL
+		} else if event.Op&fsnotify.Rename == fsnotify.Rename {
+			// the file is gone from this path; if it shows up at a new path, the two changes are paired into a rename before shipping
+			log.Printf("Renamed %s (%s)\n", event.Name, event.Op)
+			fileChange.Change = FILE_DEL
+		} else if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+			// writes often come with a CHMOD too, so only count it if the permissions actually changed
+			if !permissionsChanged(shareID, fileChange.File, event.Name) {
+				return nil, false
+			}
+			log.Printf("Changed permissions of %s (%s)\n", event.Name, event.Op)
+			fileChange.Change = FILE_META
 		} else {
-			// ignore other changes types, such as CHMOD
 			log.Printf("unhandled file change: %s (%s)\n", event.Name, event.Op)
 			return nil, false
 		}
 
 		switch fileChange.Change {
 		case FILE_MOD:
-			isDir, err := util.IsDirectory(event.Name)
+			info, err := statFile(event.Name)
 			if err != nil {
 				log.Println("failed to get file info:", err)
 			}
+			isDir := err == nil && info.IsDir()
+			if !isDir && err == nil && alreadyReported(shareID, event.Name, info) {
+				// a write event left over from a change that already finished and was reported
+				return nil, false
+			}
 			waitForCompletion(event.Name, isDir)
 			fileChange.IsDir = isDir
 			if isDir {
+				// the directory itself and everything in it (including empty sub-directories) are new
 				changes := make([]FileChange, 0)
-				nestedFiles, err := util.GetAllFilesUnderDirectory(fileChange.FullPath)
+				err := util.Walk(dir, fileChange.FullPath, walkLinkMode(), func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					if ignoreFile(path) {
+						return nil
+					}
+					filename := util.RemovePathPrefix(path, dir)
+					// directories are indexed right away, so a deletion can tell they were directories even before they're shipped.
+					// files are hashed when their changes are shipped, so large files don't hold up the watcher
+					if info.IsDir() {
+						if _, err := indexFile(shareID, filename, path, info); err != nil {
+							log.Printf("failed to index %s: %s", filename, err)
+						}
+					}
+					changes = append(changes, FileChange{
+						File:     filename,
+						FullPath: path,
+						Change:   FILE_MOD,
+						IsDir:    info.IsDir(),
+					})
+					return nil
+				})
 				if err != nil {
 					log.Println("failed to get nested files:", err)
 					return nil, false
 				}
-				log.Println("files added from new directory:", nestedFiles)
-				for _, file := range nestedFiles {
-					changes = append(changes, FileChange{
-						File:   util.RemovePathPrefix(file, dir),
-						Change: FILE_MOD,
-					})
-				}
-				refreshIndex = true
+				log.Println("files added from new directory:", changes)
 				// restart filewatcher too, since we need to add new paths to the watcher
 				return changes, true
 			}
+			markReported(shareID, event.Name)
 			return []FileChange{fileChange}, false
 		case FILE_DEL:
-			fileInfo := GetIndexedFileInfo(fileChange.File)
+			fileInfo := GetIndexedFileInfo(shareID, fileChange.File)
+			if fileInfo != nil {
+				fileChange.IsDir = fileInfo.IsDir
+			}
+			return []FileChange{fileChange}, false
+		case FILE_META:
+			fileInfo := GetIndexedFileInfo(shareID, fileChange.File)
 			if fileInfo != nil {
-				fileChange.IsDir = fileInfo.IsDir()
+				fileChange.IsDir = fileInfo.IsDir
 			}
-			refreshIndex = true
 			return []FileChange{fileChange}, false
 		}
 	case err, ok := <-watcher.Errors:
@@ -217,8 +245,31 @@ func awaitNextFileChange(watcher *fsnotify.Watcher, dir string) ([]FileChange, b
 	return nil, false
 }
 
+// whether a file is unchanged since it was last reported as changed.
+// copying a large file queues up lots of write events, which are all covered by the change reported once the copy finished.
+func alreadyReported(shareID string, path string, info os.FileInfo) bool {
+	lastReportedMutex.Lock()
+	defer lastReportedMutex.Unlock()
+
+	last, exists := lastReported[shareID]
+	return exists && last.path == path && last.size == info.Size() && last.modTime.Equal(info.ModTime())
+}
+
+// records a file as the last one reported as changed in a share
+func markReported(shareID string, path string) {
+	info, err := statFile(path)
+	if err != nil {
+		return
+	}
+	lastReportedMutex.Lock()
+	defer lastReportedMutex.Unlock()
+
+	lastReported[shareID] = reportedFile{path: path, size: info.Size(), modTime: info.ModTime()}
+}
+
 func waitForCompletion(fileName string, isDir bool) {
 	var lastHash [16]byte
+	first := true
 	log.Println("waiting for file completion...")
 	for {
 		var currentHash [16]byte
@@ -230,29 +281,29 @@ func waitForCompletion(fileName string, isDir bool) {
 			}
 			currentHash = dirHash
 		} else {
-			fileHash, err := hashFile(fileName)
+			info, err := os.Stat(fileName)
 			if err != nil {
 				log.Println("error hashing file:", err)
 				return
 			}
-			currentHash = fileHash
+			currentHash = hashFileStat(fileName, info)
 		}
-		if currentHash == lastHash {
+		// always check at least twice; an empty directory hashes to the same value as the initial lastHash
+		if currentHash == lastHash && !first {
 			// No change detected in file content
 			break
 		}
 		lastHash = currentHash
+		first = false
 		time.Sleep(100 * time.Millisecond)
 	}
 	log.Println("file completed.")
 }
 
-func hashFile(fileName string) ([16]byte, error) {
-	file, err := os.ReadFile(fileName)
-	if err != nil {
-		return [16]byte{}, err
-	}
-	return md5.Sum(file), nil
+// hashes the path, size and modification time of a file. every write changes them, so they show whether a file is still being written
+// just as well as its contents do, without reading the whole file each time it's checked.
+func hashFileStat(fileName string, info os.FileInfo) [16]byte {
+	return md5.Sum([]byte(fmt.Sprintf("%s:%v:%v", fileName, info.Size(), info.ModTime().UnixNano())))
 }
 
 func hashDirectory(dirPath string) ([16]byte, error) {
@@ -263,11 +314,7 @@ func hashDirectory(dirPath string) ([16]byte, error) {
 			return err
 		}
 		if !info.IsDir() {
-			fileHash, err := hashFile(path)
-			if err != nil {
-				return err
-			}
-			combinedHash = combineHashes(combinedHash, fileHash)
+			combinedHash = combineHashes(combinedHash, hashFileStat(path, info))
 		}
 		return nil
 	})
@@ -286,6 +333,16 @@ func combineHashes(hash1, hash2 [16]byte) [16]byte {
 	return combined
 }
 
+// whether a file's permissions are different from the ones in the index
+func permissionsChanged(shareID string, filename string, fullPath string) bool {
+	info, err := statFile(fullPath)
+	if err != nil {
+		return false
+	}
+	entry := GetIndexedFileInfo(shareID, filename)
+	return entry != nil && !entry.Deleted && entry.Mode.Perm() != info.Mode().Perm()
+}
+
 // returns whether the file should be ignored or not, such as if it's some autogenerated file for specific OS
 func ignoreFile(filename string) bool {
 	// ignore .swp files, which linux generates while editing some files
@@ -296,6 +353,12 @@ func ignoreFile(filename string) bool {
 	if strings.HasSuffix(filename, ".DS_Store") {
 		return true
 	}
+	// ignore files that are still being received from other nodes
+	for _, part := range strings.Split(filename, string(os.PathSeparator)) {
+		if part == c.STAGING_DIR {
+			return true
+		}
+	}
 	return false
 }
 
@@ -308,57 +371,114 @@ func getFullFilePath(filename string, config c.Config) string {
 }
 
 // queues up a file change and triggers the file changes broadcast after a short delay
-func queueFileChange(fileChange FileChange) {
+func queueFileChange(fileChange FileChange, config c.Config) {
 	fileChange.File = strings.TrimSpace(fileChange.File)
 	if fileChange.File == "" {
 		fmt.Println("failed to queue change: empty file name!")
 		return
 	}
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
 	// ship the file changes after a short delay, to make sure any simultaneous file changes are all accounted for together
 	// sometimes when a file is changed, under the hood there are multiple changes occurring (a WRITE and CHMOD, for example), and we don't want to send out multiple file change notifications in such cases.
-	if !changeFlag {
+	if !changeFlag[config.ShareID] {
 		go func() {
 			time.Sleep(1 * time.Second)
-			shipFileChanges()
+			shipFileChanges(config)
 		}()
-		changeFlag = true
+		changeFlag[config.ShareID] = true
 	}
 	// make sure the given filechange isn't already queued
-	for _, f := range changedFiles {
+	queued := changedFiles[config.ShareID]
+	for i, f := range queued {
 		if f.File == fileChange.File {
-			if f.Change != fileChange.Change {
+			// a modification covers a permissions change too, since the new permissions are sent along with the file
+			if f.Change == FILE_META && fileChange.Change == FILE_MOD {
+				queued[i] = fileChange
+				return
+			}
+			if f.Change != fileChange.Change && !(f.Change == FILE_MOD && fileChange.Change == FILE_META) {
 				log.Printf("file (%s) already queued, but has a different change type? (prev: %s, new: %s)\n", f.File, f.Change, fileChange.Change)
 			}
 			return
 		}
 	}
-	changedFiles = append(changedFiles, fileChange)
+	changedFiles[config.ShareID] = append(queued, fileChange)
 }
 
-// ships file changes to be broadcast to other nodes.
-func shipFileChanges() {
-	if len(changedFiles) == 0 {
+// ships the file changes of a share to be broadcast to the share's other nodes.
+// each change is recorded in the file's version vector, so other nodes can tell whether it is newer than their copy.
+func shipFileChanges(config c.Config) {
+	// take the queued changes, and reset them
+	changesMutex.Lock()
+	changes := changedFiles[config.ShareID]
+	delete(changedFiles, config.ShareID)
+	changeFlag[config.ShareID] = false
+	changesMutex.Unlock()
+
+	if len(changes) == 0 {
 		fmt.Println("no file changes queued?")
 		return
 	}
-	// reset changes
-	defer func() {
-		changedFiles = []FileChange{}
-		changeFlag = false
-	}()
+	// a share that's receive-only with every peer never sends its local changes out; they're only flagged.
+	// otherwise they're versioned, and only sent to the peers that aren't receive-only (see BroadcastMessage)
+	if !config.SendsChanges() {
+		for _, fileChange := range changes {
+			flagLocalChange(fileChange.File, fileChange.IsDir, config)
+		}
+		return
+	}
 	// broadcast file changes
-	for _, fileChange := range changedFiles {
-		messagebroker.BroadcastMessage(m.NotifyFileChange{
+	for _, fileChange := range pairRenames(changes, config) {
+		notification := m.NotifyFileChange{
 			Type:   c.TYPE_FILE_CHANGE_NOTIFY,
+			Share:  config.ShareID,
 			File:   fileChange.File,
 			IsDir:  fileChange.IsDir,
 			Change: fileChange.Change,
-		})
+			Node:   config.NodeID(),
+			Time:   time.Now().UTC(),
+		}
+		if fileChange.Change != FILE_DEL {
+			entry, err := indexFile(config.ShareID, fileChange.File, getFullFilePath(fileChange.File, config), nil)
+			if err != nil {
+				log.Println("failed to index changed file:", err)
+				continue
+			}
+			notification.Checksum = entry.Hash
+			notification.Mode = entry.Mode
+			notification.Size = entry.Size
+			notification.LinkTarget = entry.LinkTarget
+		}
+		switch fileChange.Change {
+		case FILE_MOD, FILE_META:
+			notification.Version = bumpFileVersion(config.ShareID, fileChange.File, config.NodeID(), fileChange.IsDir, false)
+		case FILE_DEL:
+			notification.Version = bumpFileVersion(config.ShareID, fileChange.File, config.NodeID(), fileChange.IsDir, true)
+			if fileChange.IsDir {
+				markNestedFilesDeleted(config.ShareID, fileChange.File, config.NodeID(), notification.Time, true)
+			}
+		case FILE_RENAME:
+			notification.OldFile = fileChange.OldFile
+			notification.OldVersion, notification.Version = renameIndexEntry(config.ShareID, fileChange.OldFile, fileChange.File, config.NodeID(), notification.Time)
+		}
+		messagebroker.BroadcastMessage(notification, config)
+	}
+}
+
+// flags a local change to a file in a receive-only share. the change isn't versioned, so it isn't sent to other nodes,
+// and the next remote change to the file overwrites it.
+func flagLocalChange(filename string, isDir bool, config c.Config) {
+	log.Printf("%s was changed locally, but share %s is receive-only; the change won't be sent to other nodes\n", filename, config.ShareID)
+	if _, err := indexFile(config.ShareID, filename, getFullFilePath(filename, config), nil); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("failed to index changed file:", err)
 	}
+	markLocalChange(config.ShareID, filename, isDir)
 }
 
 // handle a file change notification sent to this node from a peer
-func HandleRemoteFileChange(fileChange m.NotifyFileChange, remoteIP string, config c.Config) {
+func HandleRemoteFileChange(fileChange m.NotifyFileChange, p m.Peer, config c.Config) {
 	if fileChange.File == "" {
 		log.Println("error handling remote file change: no file name provided")
 		return
@@ -367,36 +487,203 @@ func HandleRemoteFileChange(fileChange m.NotifyFileChange, remoteIP string, conf
 		log.Println("error handling remote file change: no file change type provided (needs mod, del, etc)")
 		return
 	}
-	// flag that incoming changes are remote - and shouldn't be rebroadcasted
-	applyingRemoteChanges = true
-	defer func() {
-		applyingRemoteChanges = false
-	}()
+	// the peer doesn't get to touch anything outside of the shared directory
+	for _, filename := range []string{fileChange.File, fileChange.OldFile} {
+		if filename == "" {
+			continue
+		}
+		if _, err := util.SafeJoin(config.SharedDirectoryPath, filename, c.STAGING_DIR); err != nil {
+			log.Println("rejecting remote file change:", err)
+			return
+		}
+	}
+	// and can't create files this node's operating system doesn't allow
+	if fileChange.Change != FILE_DEL {
+		if err := util.CheckCreatable(fileChange.File); err != nil {
+			log.Println("ignoring remote file change:", err)
+			return
+		}
+	}
+	if fileChange.LinkTarget != "" && symlinkPolicy == c.SYMLINK_IGNORE {
+		fmt.Println("ignoring remote change to symbolic link:", fileChange.File)
+		return
+	}
+	// a send-only share's copy is the authoritative one, so it's never overwritten by a peer it's send-only with.
+	// the mode is looked up by the ID the peer connected with, not by whoever is at its IP now
+	if config.GetSyncMode(p.ID) == c.SYNC_SEND_ONLY {
+		fmt.Printf("ignoring remote change to %s from %s: share %s is send-only with that peer\n", fileChange.File, p.IP, config.ShareID)
+		return
+	}
+	// mark the files being changed, so the changes aren't mistaken for local ones and sent back out
+	paths := []string{getFullFilePath(fileChange.File, config)}
+	if fileChange.OldFile != "" {
+		paths = append(paths, getFullFilePath(fileChange.OldFile, config))
+	}
+	defer applyingRemoteChange(paths...)()
+
+	// only apply changes that are newer than our own copy of the file
+	localVersion := GetFileVersion(config.ShareID, fileChange.File)
+	comparison := fileChange.Version.Compare(localVersion)
+	if comparison == m.VERSION_EQUAL || comparison == m.VERSION_OLDER {
+		fmt.Printf("ignoring remote change to %s: local version %s is up to date (remote: %s)\n", fileChange.File, localVersion, fileChange.Version)
+		return
+	}
+	// if we already have the exact same contents, there's nothing to transfer
+	if (fileChange.Change == FILE_MOD || fileChange.Change == FILE_META) && fileChange.Checksum != "" {
+		if entry := GetIndexedFileInfo(config.ShareID, fileChange.File); entry != nil && !entry.Deleted && entry.Hash == fileChange.Checksum {
+			fmt.Println("already have the contents of remote change:", fileChange.File)
+			applyRemoteMetadata(fileChange, localVersion, config)
+			return
+		}
+	}
+
+	if comparison == m.VERSION_CONCURRENT {
+		handleConflict(fileChange, localVersion, p, config)
+		return
+	}
 
 	switch fileChange.Change {
 	case FILE_MOD:
-		_, err := filetransfer.RequestFile(remoteIP, fileChange.File)
-		if err != nil {
-			log.Println("error requesting file change:", err)
+		applyRemoteModification(fileChange, localVersion, p, config)
+	case FILE_DEL:
+		applyRemoteDeletion(fileChange, localVersion, config)
+	case FILE_RENAME:
+		applyRemoteRename(fileChange, localVersion, p, config)
+	case FILE_META:
+		if fileChange.IsDir {
+			applyRemoteMetadata(fileChange, localVersion, config)
 			return
 		}
-		fmt.Println("successfully retrieved file change from peer:", fileChange.File)
-	case FILE_DEL:
-		// delete the file
-		fmt.Println("received file deletion change")
-		filePath := getFullFilePath(fileChange.File, config)
-		if filePath == "" {
-			log.Println("failed to delete file; no filepath provided")
+		// our copy has different contents (otherwise it would have been handled above), so get the whole file
+		applyRemoteModification(fileChange, localVersion, p, config)
+	}
+}
+
+func applyRemoteModification(fileChange m.NotifyFileChange, localVersion m.VersionVector, p m.Peer, config c.Config) {
+	if fileChange.IsDir {
+		applyRemoteDirectory(fileChange, localVersion, config)
+		return
+	}
+	version, err := receiveFileChange(fileChange, p, config, nil)
+	if err != nil {
+		log.Println("error requesting file change:", err)
+		return
+	}
+	// the peer may have changed the file again since notifying us, so record the version it actually sent
+	setFileVersion(config.ShareID, fileChange.File, localVersion.Merge(version), false)
+	fmt.Println("successfully retrieved file change from peer:", fileChange.File)
+}
+
+func applyRemoteDeletion(fileChange m.NotifyFileChange, localVersion m.VersionVector, config c.Config) {
+	fmt.Println("received file deletion change")
+	filePath := getFullFilePath(fileChange.File, config)
+	if filePath == "" {
+		log.Println("failed to delete file; no filepath provided")
+		return
+	}
+	if fileChange.IsDir {
+		if err := os.RemoveAll(filePath); err != nil {
+			log.Println("failed to remove directory:", err)
 			return
 		}
-		if fileChange.IsDir {
-			if err := os.RemoveAll(filePath); err != nil {
-				log.Println("failed to remove directory:", err)
-			}
+		markNestedFilesDeleted(config.ShareID, fileChange.File, fileChange.Node, fileChange.Time, false)
+	} else if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("failed to remove file:", err)
+		return
+	}
+	// keep the version of the deleted file, so an older copy of it isn't mistaken for a newer one
+	recordDeletion(config.ShareID, fileChange.File, localVersion.Merge(fileChange.Version), fileChange.IsDir, fileChange.Node, fileChange.Time)
+}
+
+// applies a peer's file permissions to our own copy of the file, which already has the same contents
+func applyRemoteMetadata(fileChange m.NotifyFileChange, localVersion m.VersionVector, config c.Config) {
+	filePath := getFullFilePath(fileChange.File, config)
+	if filePath == "" {
+		log.Println("failed to update file permissions; no filepath provided")
+		return
+	}
+	// chmod would change the permissions of a link's target rather than the link, and links don't have permissions of their own anyway
+	if fileChange.Mode != 0 && fileChange.LinkTarget == "" {
+		if err := os.Chmod(filePath, fileChange.Mode.Perm()); err != nil {
+			log.Println("failed to update file permissions:", err)
 			return
 		}
-		if err := os.Remove(filePath); err != nil {
-			log.Println("failed to remove file:", err)
+		if _, err := indexFile(config.ShareID, fileChange.File, filePath, nil); err != nil {
+			log.Println("failed to index file:", err)
+		}
+	}
+	setFileVersion(config.ShareID, fileChange.File, localVersion.Merge(fileChange.Version), fileChange.IsDir)
+}
+
+// creates a directory that was created by a peer
+func applyRemoteDirectory(fileChange m.NotifyFileChange, localVersion m.VersionVector, config c.Config) {
+	dirPath := getFullFilePath(fileChange.File, config)
+	if dirPath == "" {
+		log.Println("failed to create directory; no filepath provided")
+		return
+	}
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		log.Println("failed to create directory:", err)
+		return
+	}
+	if fileChange.Mode != 0 {
+		if err := os.Chmod(dirPath, fileChange.Mode.Perm()); err != nil {
+			log.Println("failed to set directory permissions:", err)
+		}
+	}
+	if _, err := indexFile(config.ShareID, fileChange.File, dirPath, nil); err != nil {
+		log.Println("failed to index new directory:", err)
+	}
+	setFileVersion(config.ShareID, fileChange.File, localVersion.Merge(fileChange.Version), true)
+	fmt.Println("created directory from peer:", fileChange.File)
+}
+
+// gets the contents of a remote change: symbolic links are created from the notification itself, and anything else is requested from the peer.
+// beforeCommit, if given, is called right before the received file or link replaces the current copy. returns the version that was received.
+func receiveFileChange(fileChange m.NotifyFileChange, p m.Peer, config c.Config, beforeCommit filetransfer.BeforeCommit) (m.VersionVector, error) {
+	if fileChange.LinkTarget != "" {
+		if beforeCommit != nil {
+			if err := beforeCommit(getFullFilePath(fileChange.File, config)); err != nil {
+				return nil, err
+			}
+		}
+		return fileChange.Version, createLink(fileChange, config)
+	}
+	header, err := fetchFile(p, fileChange.File, fileChange.Version, config, beforeCommit)
+	if err != nil {
+		return nil, err
+	}
+	return header.Version, nil
+}
+
+// requests a file from a peer, and indexes the received file. only the chunks of the file that aren't already in the shared directory are transferred,
+// and any other peers that have the same version of the file help send them.
+// if the transfer fails, e.g. because the file didn't arrive intact, it is requested from the other peers instead,
+// as long as they have the given version of the file (or a newer one).
+func fetchFile(remote m.Peer, filename string, version m.VersionVector, config c.Config, beforeCommit filetransfer.BeforeCommit) (*m.FileTransferHeader, error) {
+	share, exists := config.GetShare(config.ShareID)
+	if !exists {
+		return nil, fmt.Errorf("unknown share: %s", config.ShareID)
+	}
+	locate := chunkLocator(config)
+	peers := []m.Peer{remote}
+	for _, p := range state.GetPeers() {
+		// only peers the share is synced with have the file
+		if p.ID != remote.ID && share.HasMember(p.ID) {
+			peers = append(peers, p)
 		}
 	}
+	header, err := filetransfer.RequestFileChunks(peers, config, filename, version, locate, beforeCommit)
+	// each retry starts from the next peer, so a different peer is the one that has to have the version we want
+	for i := 1; err != nil && i < len(peers); i++ {
+		log.Printf("failed to get %s from %s (%s); trying %s instead\n", filename, peers[i-1].IP, err, peers[i].IP)
+		header, err = filetransfer.RequestFileChunks(append(append([]m.Peer{}, peers[i:]...), peers[:i]...), config, filename, version, locate, beforeCommit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := indexFile(config.ShareID, filename, getFullFilePath(filename, config), nil); err != nil {
+		log.Println("failed to index received file:", err)
+	}
+	return header, nil
 }
@@ -5,9 +5,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
 	"github.com/webbben/p2p-file-share/internal/util"
 )
 
@@ -78,6 +81,21 @@ func TestAwaitNextFileChange(t *testing.T) {
 		{
 			ScriptName: "copy_dir.sh",
 			Exp: []FileChange{
+				{
+					File:   "copydir",
+					IsDir:  true,
+					Change: FILE_MOD,
+				},
+				{
+					File:   "copydir/x",
+					IsDir:  true,
+					Change: FILE_MOD,
+				},
+				{
+					File:   "copydir/x/y",
+					IsDir:  true,
+					Change: FILE_MOD,
+				},
 				{
 					File:   "copydir/a.txt",
 					IsDir:  false,
@@ -122,6 +140,16 @@ func TestAwaitNextFileChange(t *testing.T) {
 		{
 			ScriptName: "copy_large_dir.sh",
 			Exp: []FileChange{
+				{
+					File:   "a",
+					IsDir:  true,
+					Change: FILE_MOD,
+				},
+				{
+					File:   "a/b",
+					IsDir:  true,
+					Change: FILE_MOD,
+				},
 				{
 					File:   "a/file_a",
 					IsDir:  false,
@@ -196,12 +224,13 @@ func TestAwaitNextFileChange(t *testing.T) {
 	defer os.RemoveAll(filepath.Join(wd, "test_temp"))
 
 	// start tracking file changes
-	RefreshFileIndex(testdir)
+	indexTestDir(c.DEFAULT_SHARE_ID, testdir)
 	detectedChanges := make([]FileChange, 0)
+	var detectedMutex sync.Mutex
 	go func() {
 		restartCount := 0
 		for {
-			changes, restart := awaitNextFileChange(watcher, testdir)
+			changes, restart := awaitNextFileChange(watcher, testdir, c.DEFAULT_SHARE_ID)
 			if restart {
 				if !watcherOpen {
 					break
@@ -213,7 +242,9 @@ func TestAwaitNextFileChange(t *testing.T) {
 					return
 				}
 			}
-			detectedChanges = changes
+			detectedMutex.Lock()
+			detectedChanges = append(detectedChanges, changes...)
+			detectedMutex.Unlock()
 		}
 	}()
 	// wait a second to make sure the file change watcher is working
@@ -229,7 +260,7 @@ func TestAwaitNextFileChange(t *testing.T) {
 		// wait up to 5-ish seconds for new changes to come in.
 		// in reality it should only take at most a couple hundred milliseconds
 		count := 0
-		for len(detectedChanges) == 0 {
+		for detectedCount(&detectedMutex, &detectedChanges) == 0 {
 			time.Sleep(100 * time.Millisecond)
 			count++
 			if count > 50 {
@@ -237,6 +268,7 @@ func TestAwaitNextFileChange(t *testing.T) {
 				break
 			}
 		}
+		detectedMutex.Lock()
 		for _, expChange := range testCase.Exp {
 			found := false
 			for _, change := range detectedChanges {
@@ -255,7 +287,51 @@ func TestAwaitNextFileChange(t *testing.T) {
 			t.Log("got:", detectedChanges)
 		}
 		detectedChanges = make([]FileChange, 0)
+		detectedMutex.Unlock()
 		log.Printf("%s: End\n", testCase.Name)
 	}
 	watcherOpen = false
 }
+
+func detectedCount(mutex *sync.Mutex, changes *[]FileChange) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(*changes)
+}
+
+func TestRejectUnsafeRemoteChanges(t *testing.T) {
+	wd := util.Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "testunsafe")
+	root := filepath.Join(testdir, "root")
+	victim := filepath.Join(testdir, "victim")
+	defer os.RemoveAll(testdir)
+
+	for _, dir := range []string{root, victim} {
+		if err := util.EnsureDir(dir); err != nil {
+			t.Error("failed to create test directory:", err)
+			return
+		}
+	}
+	if err := os.WriteFile(filepath.Join(victim, "important.txt"), []byte("important"), 0644); err != nil {
+		t.Error("failed to write test file:", err)
+		return
+	}
+	config := c.Config{SharedDirectoryPath: root}
+
+	for _, fileChange := range []m.NotifyFileChange{
+		{File: filepath.Join("..", "victim"), Change: FILE_DEL, IsDir: true},
+		{File: filepath.Join(victim, "important.txt"), Change: FILE_DEL},
+		{File: "moved.txt", OldFile: filepath.Join("..", "victim", "important.txt"), Change: FILE_RENAME},
+	} {
+		fileChange.Version = m.VersionVector{"attacker": 1}
+		HandleRemoteFileChange(fileChange, m.Peer{ID: "attacker", IP: "10.0.0.6"}, config)
+		if _, err := os.Stat(filepath.Join(victim, "important.txt")); err != nil {
+			t.Errorf("remote change to %s reached outside the shared directory: %s", fileChange.File, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package syncdir
+
+import (
+	"fmt"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+	"github.com/webbben/p2p-file-share/internal/peer"
+	"github.com/webbben/p2p-file-share/internal/state"
+)
+
+// records that a peer has a deleted file's tombstone, if the peer's version of the deletion is at least as new as ours
+func acknowledgeTombstone(shareID string, filename string, peerID string, remoteVersion m.VersionVector) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	entry, exists := index[filename]
+	if !exists || !entry.Deleted {
+		return
+	}
+	if comparison := remoteVersion.Compare(entry.Version); comparison != m.VERSION_EQUAL && comparison != m.VERSION_NEWER {
+		return
+	}
+	if entry.AckedBy[peerID] {
+		return
+	}
+	ackedBy := make(map[string]bool, len(entry.AckedBy)+1)
+	for id := range entry.AckedBy {
+		ackedBy[id] = true
+	}
+	ackedBy[peerID] = true
+	entry.AckedBy = ackedBy
+	index[filename] = entry
+	saveFileIndex()
+}
+
+// forgets the tombstones of deleted files in a share once every known member of the share has acknowledged them.
+// the members come from the historic peers list and the known peers file, so peers that haven't been seen since the last restart are still waited for,
+// and so are peers that still have to pair again (e.g. after the cluster secret changed). until then, the tombstones are kept so that a peer
+// that still has the file doesn't bring it back.
+func collectTombstones(config c.Config) {
+	known := map[string]bool{}
+	for key := range state.GetHistoricalPeers() {
+		known[key] = true
+	}
+	for id := range peer.GetKnownPeers() {
+		known[id] = true
+	}
+	members := []string{}
+	for key := range known {
+		if config.IsShareMember(key) {
+			members = append(members, key)
+		}
+	}
+	forgetAckedTombstones(config.ShareID, members)
+}
+
+// forgets the tombstones of deleted files in a share that have been acknowledged by all the given peers
+func forgetAckedTombstones(shareID string, peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	index := shareIndex(shareID)
+	collected := 0
+	for filename, entry := range index {
+		if !entry.Deleted || !ackedByAll(entry, peers) {
+			continue
+		}
+		delete(index, filename)
+		collected++
+	}
+	if collected > 0 {
+		fmt.Printf("forgot %v tombstones acknowledged by all peers\n", collected)
+		saveFileIndex()
+	}
+}
+
+func ackedByAll(entry IndexEntry, peers []string) bool {
+	for _, id := range peers {
+		if !entry.AckedBy[id] {
+			return false
+		}
+	}
+	return true
+}
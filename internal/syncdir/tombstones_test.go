@@ -0,0 +1,38 @@
+package syncdir
+
+import (
+	"testing"
+	"time"
+
+	c "github.com/webbben/p2p-file-share/internal/config"
+	m "github.com/webbben/p2p-file-share/internal/model"
+)
+
+func TestCollectTombstones(t *testing.T) {
+	members := []string{"peer2", "peer3"}
+
+	filename := "tombstone_test.txt"
+	version := bumpFileVersion(c.DEFAULT_SHARE_ID, filename, "node", false, true)
+
+	// older versions of the deletion don't count as an acknowledgement
+	acknowledgeTombstone(c.DEFAULT_SHARE_ID, filename, "peer2", m.VersionVector{})
+	acknowledgeTombstone(c.DEFAULT_SHARE_ID, filename, "peer3", version)
+	forgetAckedTombstones(c.DEFAULT_SHARE_ID, members)
+	if entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filename); entry == nil || !entry.Deleted || entry.DeletedBy != "node" {
+		t.Errorf("tombstone was forgotten before every peer acknowledged it: %+v", entry)
+		return
+	}
+
+	acknowledgeTombstone(c.DEFAULT_SHARE_ID, filename, "peer2", version.Increment("other"))
+	forgetAckedTombstones(c.DEFAULT_SHARE_ID, members)
+	if entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filename); entry != nil {
+		t.Errorf("tombstone should have been forgotten: %+v", entry)
+	}
+
+	// recreating the file clears the tombstone
+	recordDeletion(c.DEFAULT_SHARE_ID, filename, version, false, "node", time.Now())
+	bumpFileVersion(c.DEFAULT_SHARE_ID, filename, "node", false, false)
+	if entry := GetIndexedFileInfo(c.DEFAULT_SHARE_ID, filename); entry == nil || entry.Deleted || entry.AckedBy != nil {
+		t.Errorf("recreated file still has a tombstone: %+v", entry)
+	}
+}
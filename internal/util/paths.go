@@ -0,0 +1,119 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	// a path from another node that could reach outside of the shared directory, or into a part of it that isn't synced
+	ErrUnsafePath = errors.New("unsafe path")
+	// a file name that can't be used on this operating system
+	ErrReservedName = errors.New("reserved file name")
+)
+
+// names that are reserved for devices on Windows, with or without an extension; files with these names can't be created there
+var windowsDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checks the path of a file in a shared directory that was sent by another node, and returns it cleaned up.
+// the path has to be relative to the shared directory, and can't:
+//
+//   - be absolute, or start with a volume name
+//   - go up a directory with ".."
+//   - go through one of the given reserved names (like the staging directory)
+//
+// both kinds of path separators are checked, since the path may come from a node on a different operating system.
+func CleanSharedPath(name string, reserved ...string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("%w: %s is an absolute path", ErrUnsafePath, name)
+	}
+	for _, part := range splitPath(name) {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %s goes up a directory", ErrUnsafePath, name)
+		}
+		if isReservedName(part, reserved) {
+			return "", fmt.Errorf("%w: %s uses the reserved name %q", ErrUnsafePath, name, part)
+		}
+	}
+	cleaned := filepath.Clean(name)
+	if cleaned == "." {
+		return "", fmt.Errorf("%w: %q is the shared directory itself", ErrUnsafePath, name)
+	}
+	return cleaned, nil
+}
+
+// splits a path into its parts at both kinds of path separators
+func splitPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+}
+
+func isReservedName(part string, reserved []string) bool {
+	for _, name := range reserved {
+		if part == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that a file with the given path (relative to the shared directory) can be created on this operating system.
+// other nodes may be on an operating system that allows names this one doesn't, like CON or NUL.txt on Windows; files with those names can't be synced here.
+func CheckCreatable(name string) error {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	for _, part := range splitPath(name) {
+		if isWindowsDeviceName(part) {
+			return fmt.Errorf("%w: %s uses the name %q, which is reserved on Windows", ErrReservedName, name, part)
+		}
+	}
+	return nil
+}
+
+func isWindowsDeviceName(part string) bool {
+	base, _, _ := strings.Cut(part, ".")
+	return windowsDeviceNames[strings.ToUpper(base)]
+}
+
+// joins the path of a file that was sent by another node onto the shared directory at root, after checking it with CleanSharedPath.
+// symbolic links along the way are resolved too, so that a link inside the shared directory can't be used to reach files outside of it.
+func SafeJoin(root string, name string, reserved ...string) (string, error) {
+	cleaned, err := CleanSharedPath(name, reserved...)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(root, cleaned)
+	if !IsInsideDirectory(root, resolveExisting(fullPath)) {
+		return "", fmt.Errorf("%w: %s leads outside the shared directory through a symbolic link", ErrUnsafePath, name)
+	}
+	return fullPath, nil
+}
+
+// resolves the symbolic links in the part of a path that already exists. the rest of the path is left as it is,
+// since it will be created as regular files and directories.
+func resolveExisting(path string) string {
+	rest := ""
+	for dir := path; ; {
+		if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(realDir, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCleanSharedPath(t *testing.T) {
+	safe := map[string]string{
+		"file.txt":                  "file.txt",
+		"dir/sub/file.txt":          filepath.Join("dir", "sub", "file.txt"),
+		"dir/./file.txt":            filepath.Join("dir", "file.txt"),
+		"..hidden":                  "..hidden",
+		"notes..txt":                "notes..txt",
+		"console.txt":               "console.txt",
+		"dir/.p2p-staging-old/x":    filepath.Join("dir", ".p2p-staging-old", "x"),
+		"dir/sub/":                  filepath.Join("dir", "sub"),
+		"a file with spaces (1).md": "a file with spaces (1).md",
+		"dir/nul.txt":               filepath.Join("dir", "nul.txt"), // only reserved on Windows, where it can't be created (see CheckCreatable)
+	}
+	for name, exp := range safe {
+		cleaned, err := CleanSharedPath(name, ".p2p-staging")
+		if err != nil {
+			t.Errorf("%q should be allowed: %s", name, err)
+		} else if cleaned != exp {
+			t.Errorf("%q: expected %q, got %q", name, exp, cleaned)
+		}
+	}
+
+	unsafe := []string{
+		"",
+		".",
+		"./",
+		"/etc/passwd",
+		`\windows\system32`,
+		"..",
+		"../../etc/passwd",
+		"dir/../../etc/passwd",
+		"dir/..",
+		`..\..\etc\passwd`,
+		`dir\..\..\secret`,
+		"file\x00.txt",
+		".p2p-staging/abc.part",
+		"dir/.p2p-staging/abc.header",
+	}
+	for _, name := range unsafe {
+		if cleaned, err := CleanSharedPath(name, ".p2p-staging"); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q should be rejected, got %q (%v)", name, cleaned, err)
+		}
+	}
+}
+
+func TestCheckCreatable(t *testing.T) {
+	for _, name := range []string{"file.txt", "console.txt", "dir/notes.con"} {
+		if err := CheckCreatable(name); err != nil {
+			t.Errorf("%q should be creatable: %s", name, err)
+		}
+	}
+	// names reserved for devices can only be created where they aren't reserved
+	for _, name := range []string{"CON", "dir/nul.txt", `dir\Lpt1`, "com9.log"} {
+		err := CheckCreatable(name)
+		if runtime.GOOS == "windows" && !errors.Is(err, ErrReservedName) {
+			t.Errorf("%q should be rejected on Windows, got %v", name, err)
+		}
+		if runtime.GOOS != "windows" && err != nil {
+			t.Errorf("%q should be creatable on %s: %s", name, runtime.GOOS, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	wd := Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "temp_safejoin_test")
+	root := filepath.Join(testdir, "root")
+	outside := filepath.Join(testdir, "outside")
+	defer os.RemoveAll(testdir)
+
+	if err := makeEscapeTestFiles(root, outside); err != nil {
+		t.Error("failed to set up test files:", err)
+		return
+	}
+
+	for _, name := range []string{"file.txt", "sub/file.txt", "sub/new/dir/file.txt", "inside/file.txt"} {
+		fullPath, err := SafeJoin(root, name, ".p2p-staging")
+		if err != nil {
+			t.Errorf("%q should be allowed: %s", name, err)
+		} else if fullPath != filepath.Join(root, filepath.FromSlash(name)) {
+			t.Errorf("%q: unexpected full path %q", name, fullPath)
+		}
+	}
+	// links that lead out of the shared directory can't be used to read, write or delete anything there
+	for _, name := range []string{"escape", "escape/secret.txt", "escape/new/file.txt", "sub/secret-link", "../outside/secret.txt"} {
+		if fullPath, err := SafeJoin(root, name, ".p2p-staging"); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q should be rejected, got %q (%v)", name, fullPath, err)
+		}
+	}
+}
+
+// makes a shared directory at root with links that lead out of it to outside, and one that stays inside it
+func makeEscapeTestFiles(root string, outside string) error {
+	if err := os.MkdirAll(filepath.Join(root, "sub"), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outside, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		return err
+	}
+	links := map[string]string{
+		filepath.Join(root, "escape"):             outside,
+		filepath.Join(root, "sub", "secret-link"): filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "inside"):             "sub",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// how Walk handles symbolic links
+type LinkMode int
+
+const (
+	LINKS_AS_LINKS LinkMode = iota // links are passed to walkFn as links (not followed), but only if they point somewhere inside root
+	LINKS_FOLLOW                   // links are followed, and walkFn gets the info of whatever they point to, under the link's own path. links pointing outside of root, and links to directories that were already walked (loops), are skipped
+	LINKS_SKIP                     // links are skipped
+)
+
+// walks a directory like filepath.Walk, handling symbolic links according to linkMode.
+// root is the shared directory that links must stay inside of; dir is the directory to walk, which should be root or somewhere inside it.
+func Walk(root string, dir string, linkMode LinkMode, walkFn filepath.WalkFunc) error {
+	realDir := dir
+	if linkMode == LINKS_FOLLOW {
+		if path, err := filepath.EvalSymlinks(dir); err == nil {
+			realDir = path
+		}
+	}
+	visited := map[string]bool{realDir: true}
+	return walk(root, dir, realDir, linkMode, visited, walkFn)
+}
+
+// walks realDir, reporting every path in it as if it were under dir instead
+func walk(root string, dir string, realDir string, linkMode LinkMode, visited map[string]bool, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(realDir, func(realPath string, info os.FileInfo, err error) error {
+		path := dir + strings.TrimPrefix(realPath, realDir)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return walkFn(path, info, err)
+		}
+		switch linkMode {
+		case LINKS_AS_LINKS:
+			if !LinkStaysInRoot(root, realPath) {
+				return nil
+			}
+			return walkFn(path, info, nil)
+		case LINKS_FOLLOW:
+			target, err := filepath.EvalSymlinks(realPath)
+			if err != nil || !IsInsideDirectory(root, target) {
+				return nil // broken link, or escapes the shared directory
+			}
+			targetInfo, err := os.Stat(target)
+			if err != nil {
+				return nil
+			}
+			if !targetInfo.IsDir() {
+				return walkFn(path, targetInfo, nil)
+			}
+			if visited[target] {
+				return nil // already walked this directory; following it again would loop
+			}
+			visited[target] = true
+			return walk(root, path, target, linkMode, visited, walkFn)
+		}
+		return nil
+	})
+}
+
+// whether a symbolic link points somewhere inside root, so following it can't escape the shared directory.
+func LinkStaysInRoot(root string, linkPath string) bool {
+	target, err := os.Readlink(linkPath)
+	if err != nil || !LinkTargetStaysInRoot(root, linkPath, target) {
+		return false
+	}
+	// the target itself might be (or go through) another link that leads out of root
+	realPath, err := filepath.EvalSymlinks(linkPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return true // dangling links don't lead anywhere
+	}
+	return err == nil && IsInsideDirectory(root, realPath)
+}
+
+// whether a link at linkPath with the given target would point inside root.
+// only relative targets are allowed, since absolute ones wouldn't point to the same place on other nodes.
+func LinkTargetStaysInRoot(root string, linkPath string, target string) bool {
+	if target == "" || filepath.IsAbs(target) {
+		return false
+	}
+	return IsInsideDirectory(root, filepath.Join(filepath.Dir(linkPath), target))
+}
+
+// whether path is dir itself or somewhere inside of it. paths that exist are resolved through any symbolic links first.
+func IsInsideDirectory(dir string, path string) bool {
+	if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = realDir
+	}
+	if realPath, err := filepath.EvalSymlinks(path); err == nil {
+		path = realPath
+	}
+	dir, _ = filepath.Abs(dir)
+	path, _ = filepath.Abs(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWalkSymlinks(t *testing.T) {
+	wd := Getwd()
+	if wd == "" {
+		t.Error("failed to get working directory")
+		return
+	}
+	testdir := filepath.Join(wd, "temp_walk_test")
+	root := filepath.Join(testdir, "root")
+	outside := filepath.Join(testdir, "outside")
+	defer os.RemoveAll(testdir)
+
+	if err := makeLinkTestFiles(root, outside); err != nil {
+		t.Error("failed to set up test files:", err)
+		return
+	}
+
+	tests := []struct {
+		linkMode LinkMode
+		name     string
+		expected []string
+		excluded []string
+	}{
+		{
+			linkMode: LINKS_SKIP,
+			name:     "skip",
+			expected: []string{"file.txt", "sub", "sub/nested.txt"},
+			excluded: []string{"link.txt", "sublink", "sub/loop", "abs", "escape"},
+		},
+		{
+			linkMode: LINKS_AS_LINKS,
+			name:     "as links",
+			expected: []string{"file.txt", "sub", "sub/nested.txt", "link.txt", "sublink", "sub/loop"},
+			excluded: []string{"abs", "escape", "sublink/nested.txt"},
+		},
+		{
+			linkMode: LINKS_FOLLOW,
+			name:     "follow",
+			expected: []string{"file.txt", "sub", "sub/nested.txt", "link.txt", "sublink", "sublink/nested.txt"},
+			excluded: []string{"abs", "escape", "sub/loop", "sub/loop/file.txt"},
+		},
+	}
+	for _, test := range tests {
+		paths := []string{}
+		err := Walk(root, root, test.linkMode, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, RemovePathPrefix(path, root))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: failed to walk test directory: %s", test.name, err)
+			continue
+		}
+		for _, path := range test.expected {
+			if !slices.Contains(paths, path) {
+				t.Errorf("%s: expected %s to be walked; got %v", test.name, path, paths)
+			}
+		}
+		for _, path := range test.excluded {
+			if slices.Contains(paths, path) {
+				t.Errorf("%s: expected %s not to be walked; got %v", test.name, path, paths)
+			}
+		}
+	}
+}
+
+// makes a shared directory at root with links that stay inside it, loop back up to it, and escape it to outside
+func makeLinkTestFiles(root string, outside string) error {
+	if err := os.MkdirAll(filepath.Join(root, "sub"), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outside, os.ModePerm); err != nil {
+		return err
+	}
+	for _, file := range []string{filepath.Join(root, "file.txt"), filepath.Join(root, "sub", "nested.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(file, []byte(file), 0644); err != nil {
+			return err
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "link.txt"):    "file.txt",
+		filepath.Join(root, "sublink"):     "sub",
+		filepath.Join(root, "sub", "loop"): "..",                                 // points back up at root
+		filepath.Join(root, "abs"):         filepath.Join(outside, "secret.txt"), // absolute, and outside of root
+		filepath.Join(root, "escape"):      "../outside",                         // relative, but leads out of root
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}